@@ -0,0 +1,311 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Channel modes. Anyone may read and post on an open channel; only the
+// owner and granted publishers may post on a broadcast channel; only
+// invited members may read or post on a private channel.
+const (
+	ModeOpen      = "open"
+	ModeBroadcast = "broadcast"
+	ModePrivate   = "private"
+)
+
+// serverOwner owns channels created by the server and its console.
+const serverOwner = ""
+
+var (
+	errNotAllowed      = errors.New("not allowed")
+	errNotOwner        = errors.New("not the channel owner")
+	errChannelExists   = errors.New("channel already exists")
+	errUnknownChannel  = errors.New("unknown channel")
+	errUnknownMode     = errors.New("mode must be open, broadcast or private")
+	systemChannels     = []string{worldEventsChannel, eventsChannel, achievementsChannel, leaderboardChannel, worldChannel}
+	systemChannelRoots = []string{"battle-", "raid-"}
+)
+
+// ChannelACL controls who may subscribe and publish to a channel.
+type ChannelACL struct {
+	Owner       string          `json:"owner"`
+	Mode        string          `json:"mode"`
+	Publishers  map[string]bool `json:"publishers"`
+	Subscribers map[string]bool `json:"subscribers"` // members of a private channel
+}
+
+func newChannelACL(owner, mode string) *ChannelACL {
+	return &ChannelACL{
+		Owner:       owner,
+		Mode:        mode,
+		Publishers:  make(map[string]bool),
+		Subscribers: make(map[string]bool),
+	}
+}
+
+func validMode(mode string) bool {
+	return mode == ModeOpen || mode == ModeBroadcast || mode == ModePrivate
+}
+
+func isSystemChannel(channel string) bool {
+	for _, name := range systemChannels {
+		if channel == name {
+			return true
+		}
+	}
+	for _, root := range systemChannelRoots {
+		if strings.HasPrefix(channel, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclFor returns channel's ACL. Server channels without one are broadcast
+// channels; other channels without one are open. Caller must hold s.mutex.
+func (s *Server) aclFor(channel string) *ChannelACL {
+	if acl, exists := s.acls[channel]; exists {
+		return acl
+	}
+	if isSystemChannel(channel) {
+		return newChannelACL(serverOwner, ModeBroadcast)
+	}
+	return nil
+}
+
+func (acl *ChannelACL) canSubscribe(clientID string) bool {
+	if acl == nil || acl.Mode != ModePrivate || clientID == acl.Owner {
+		return true
+	}
+	return acl.Subscribers[clientID] || acl.Publishers[clientID]
+}
+
+func (acl *ChannelACL) canPublish(clientID string) bool {
+	if acl == nil || clientID == acl.Owner || acl.Publishers[clientID] {
+		return true
+	}
+	switch acl.Mode {
+	case ModeOpen:
+		return true
+	case ModePrivate:
+		return acl.Subscribers[clientID]
+	}
+	return false
+}
+
+// clientIDOf returns the clientID connected on conn. Caller must hold
+// s.mutex.
+func (s *Server) clientIDOf(conn net.Conn) string {
+	for clientID, c := range s.clients {
+		if c == conn {
+			return clientID
+		}
+	}
+	return ""
+}
+
+// PublishMessageFrom publishes message on channel for clientID if the
+// channel's ACL lets them post and they are not muted there. Messages on
+// player channels go through the word filter.
+func (s *Server) PublishMessageFrom(clientID, channel, message string) error {
+	if s.moderation.Muted(clientID, channel) {
+		return errMuted
+	}
+	if !isSystemChannel(channel) {
+		message = s.moderation.Filter(message)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.aclFor(channel).canPublish(clientID) {
+		return errNotAllowed
+	}
+	s.publishLocked(channel, message)
+	return nil
+}
+
+// CreateChannel creates channel owned by owner with the given mode.
+func (s *Server) CreateChannel(owner, channel, mode string) error {
+	if !validMode(mode) {
+		return errUnknownMode
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.acls[channel]; exists || isSystemChannel(channel) {
+		return errChannelExists
+	}
+	if _, exists := s.channels[channel]; exists && owner != serverOwner {
+		return errChannelExists
+	}
+	s.acls[channel] = newChannelACL(owner, mode)
+	if _, exists := s.channels[channel]; !exists {
+		s.channels[channel] = make(map[net.Conn]bool)
+	}
+	return nil
+}
+
+// ManageChannel applies an ACL change to channel on behalf of clientID,
+// who must own it; the console acts as serverOwner and owns every channel.
+// action is INVITE, KICK, GRANT, REVOKE or MODE.
+func (s *Server) ManageChannel(clientID, channel, action, arg string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	acl, exists := s.acls[channel]
+	if !exists {
+		_, open := s.channels[channel]
+		if clientID != serverOwner || (!open && !isSystemChannel(channel)) {
+			return errUnknownChannel
+		}
+		// The console takes over a channel nobody manages yet.
+		if acl = s.aclFor(channel); acl == nil {
+			acl = newChannelACL(serverOwner, ModeOpen)
+		}
+		s.acls[channel] = acl
+	}
+	if clientID != serverOwner && clientID != acl.Owner {
+		return errNotOwner
+	}
+
+	switch action {
+	case "INVITE":
+		acl.Subscribers[arg] = true
+	case "KICK":
+		delete(acl.Subscribers, arg)
+		delete(acl.Publishers, arg)
+		if conn, online := s.clients[arg]; online {
+			delete(s.channels[channel], conn)
+		}
+	case "GRANT":
+		acl.Publishers[arg] = true
+	case "REVOKE":
+		delete(acl.Publishers, arg)
+	case "MODE":
+		if !validMode(arg) {
+			return errUnknownMode
+		}
+		acl.Mode = arg
+		// Drop subscribers who are no longer allowed to read.
+		for conn := range s.channels[channel] {
+			if id := s.clientIDOf(conn); !acl.canSubscribe(id) {
+				delete(s.channels[channel], conn)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown channel action %s", action)
+	}
+	return nil
+}
+
+// channelInfo describes channel's ACL. Caller must hold s.mutex.
+func (s *Server) channelInfo(channel string) (string, error) {
+	_, open := s.channels[channel]
+	acl := s.aclFor(channel)
+	if !open && acl == nil {
+		return "", errUnknownChannel
+	}
+	if acl == nil {
+		acl = newChannelACL(serverOwner, ModeOpen)
+	}
+
+	members := func(set map[string]bool) []string {
+		list := make([]string, 0, len(set))
+		for id := range set {
+			list = append(list, id)
+		}
+		sort.Strings(list)
+		return list
+	}
+	data, _ := json.Marshal(struct {
+		Channel     string   `json:"channel"`
+		Owner       string   `json:"owner"`
+		Mode        string   `json:"mode"`
+		Publishers  []string `json:"publishers"`
+		Subscribers []string `json:"subscribers"`
+	}{channel, acl.Owner, acl.Mode, members(acl.Publishers), members(acl.Subscribers)})
+	return string(data), nil
+}
+
+// HandleChannelCommand runs CHANNEL CREATE|INVITE|KICK|GRANT|REVOKE|MODE|INFO
+// for the client.
+func (s *Server) HandleChannelCommand(clientID string, conn net.Conn, args []string) {
+	if len(args) < 2 {
+		_, _ = conn.Write([]byte("Usage: CHANNEL CREATE <channel> <mode>|INVITE|KICK|GRANT|REVOKE <channel> <player>|MODE <channel> <mode>|INFO <channel>\n"))
+		return
+	}
+	action, channel := args[0], args[1]
+
+	var err error
+	switch action {
+	case "INFO":
+		s.mutex.Lock()
+		info, infoErr := s.channelInfo(channel)
+		s.mutex.Unlock()
+		if infoErr == nil {
+			_, _ = conn.Write([]byte("CHANNEL " + info + "\n"))
+			return
+		}
+		err = infoErr
+	case "CREATE":
+		mode := ModeOpen
+		if len(args) > 2 {
+			mode = args[2]
+		}
+		err = s.CreateChannel(clientID, channel, mode)
+	default:
+		if len(args) < 3 {
+			_, _ = conn.Write([]byte("Usage: CHANNEL " + action + " <channel> <arg>\n"))
+			return
+		}
+		err = s.ManageChannel(clientID, channel, action, args[2])
+	}
+	if err != nil {
+		_, _ = conn.Write([]byte("CHANNEL ERROR " + err.Error() + "\n"))
+		return
+	}
+	_, _ = conn.Write([]byte("CHANNEL OK " + action + " " + channel + "\n"))
+}
+
+// ChannelCommandInConsole runs a CHANNEL command as the server.
+func (s *Server) ChannelCommandInConsole(args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: CHANNEL CREATE <channel> <mode>|INVITE|KICK|GRANT|REVOKE <channel> <player>|MODE <channel> <mode>|INFO <channel>")
+		return
+	}
+	action, channel := args[0], args[1]
+
+	var err error
+	switch action {
+	case "INFO":
+		s.mutex.Lock()
+		info, infoErr := s.channelInfo(channel)
+		s.mutex.Unlock()
+		if infoErr == nil {
+			fmt.Println(info)
+			return
+		}
+		err = infoErr
+	case "CREATE":
+		mode := ModeBroadcast
+		if len(args) > 2 {
+			mode = args[2]
+		}
+		err = s.CreateChannel(serverOwner, channel, mode)
+	default:
+		if len(args) < 3 {
+			fmt.Printf("Usage: CHANNEL %s <channel> <arg>\n", action)
+			return
+		}
+		err = s.ManageChannel(serverOwner, channel, action, args[2])
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Channel %s: %s done\n", channel, action)
+}
@@ -0,0 +1,47 @@
+package PubSub
+
+import (
+	"testing"
+)
+
+func TestChannelACL(t *testing.T) {
+	s := newTestServer(t)
+	s.acls["open"] = newChannelACL("ash", ModeOpen)
+	s.acls["news"] = newChannelACL("ash", ModeBroadcast)
+	s.acls["news"].Publishers["misty"] = true
+	s.acls["club"] = newChannelACL("ash", ModePrivate)
+	s.acls["club"].Subscribers["misty"] = true
+	s.acls["club"].Publishers["brock"] = true
+
+	tests := []struct {
+		channel       string
+		clientID      string
+		wantSubscribe bool
+		wantPublish   bool
+	}{
+		{"lobby", "gary", true, true}, // no ACL
+		{"open", "ash", true, true},
+		{"open", "gary", true, true},
+		{"news", "ash", true, true},
+		{"news", "misty", true, true},
+		{"news", "gary", true, false},
+		{"club", "ash", true, true},
+		{"club", "misty", true, true},
+		{"club", "brock", true, true},
+		{"club", "gary", false, false},
+		{worldEventsChannel, "gary", true, false},
+		{eventsChannel, "gary", true, false},
+		{"battle-1234", "gary", true, false},
+		{"raid-r1", "gary", true, false},
+		{"raid-r1", serverOwner, true, true},
+	}
+	for _, tt := range tests {
+		acl := s.aclFor(tt.channel)
+		if got := acl.canSubscribe(tt.clientID); got != tt.wantSubscribe {
+			t.Errorf("%s on %s: canSubscribe = %v, want %v", tt.clientID, tt.channel, got, tt.wantSubscribe)
+		}
+		if got := acl.canPublish(tt.clientID); got != tt.wantPublish {
+			t.Errorf("%s on %s: canPublish = %v, want %v", tt.clientID, tt.channel, got, tt.wantPublish)
+		}
+	}
+}
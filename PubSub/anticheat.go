@@ -0,0 +1,308 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	antiCheatFile  = "anticheat.json"
+	violationsFile = "violations.jsonl"
+)
+
+// Violation kinds.
+const (
+	ViolationSpeed    = "speed"    // moved further than allowed this tick
+	ViolationTeleport = "teleport" // jumped more than TeleportDistance at once
+	ViolationFrozen   = "frozen"   // moved during an encounter or battle
+	ViolationPokemon  = "pokemon"  // acted on a Pokemon not in the party
+	ViolationRange    = "range"    // threw a ball from out of range
+)
+
+// moveOffMap rejects a move past the edge of the map. Walking into the
+// edge is not cheating, so it is not recorded as a violation.
+const moveOffMap = "offmap"
+
+// Sanction actions.
+const (
+	SanctionWarn = "warn"
+	SanctionMute = "mute"
+	SanctionKick = "kick"
+)
+
+// Sanction is applied when a player's violation count reaches Violations.
+type Sanction struct {
+	Violations int    `json:"violations"`
+	Action     string `json:"action"`
+	Minutes    int    `json:"minutes,omitempty"` // for mute
+}
+
+// AntiCheatConfig sets what the server accepts from clients and how it
+// punishes the rest.
+type AntiCheatConfig struct {
+	MaxStep          int        `json:"maxStep"`          // tiles per MOVE
+	MovesPerTick     int        `json:"movesPerTick"`     // tiles per game tick
+	TeleportDistance int        `json:"teleportDistance"` // tiles beyond which a MOVE is a teleport
+	CaptureRange     int        `json:"captureRange"`     // tiles from the encounter a ball may be thrown
+	Sanctions        []Sanction `json:"sanctions"`
+}
+
+// Violation is one logged offence.
+type Violation struct {
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"clientID"`
+	Kind     string    `json:"kind"`
+	Detail   string    `json:"detail"`
+}
+
+var antiCheat = AntiCheatConfig{
+	MaxStep:          1,
+	MovesPerTick:     2,
+	TeleportDistance: 3,
+	CaptureRange:     1,
+	Sanctions: []Sanction{
+		{Violations: 3, Action: SanctionWarn},
+		{Violations: 10, Action: SanctionMute, Minutes: 10},
+		{Violations: 20, Action: SanctionKick},
+	},
+}
+
+func LoadAntiCheat(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening anti-cheat file: %v", err)
+	}
+	defer file.Close()
+
+	config := antiCheat
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return fmt.Errorf("error decoding anti-cheat file: %v", err)
+	}
+	sort.Slice(config.Sanctions, func(i, j int) bool {
+		return config.Sanctions[i].Violations < config.Sanctions[j].Violations
+	})
+	antiCheat = config
+	return nil
+}
+
+func appendViolation(v Violation) error {
+	file, err := os.OpenFile(violationsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening violations file: %v", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(v); err != nil {
+		return fmt.Errorf("error writing violation: %v", err)
+	}
+	return nil
+}
+
+// recordViolation logs and counts a violation by clientID and applies any
+// sanction its new count reaches. Caller must hold s.mutex.
+func (s *Server) recordViolation(clientID, kind, detail string) {
+	fmt.Printf("Anti-cheat: %s %s (%s)\n", clientID, kind, detail)
+	if err := appendViolation(Violation{Time: time.Now(), ClientID: clientID, Kind: kind, Detail: detail}); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+
+	counts, exists := s.violations[clientID]
+	if !exists {
+		counts = make(map[string]int)
+		s.violations[clientID] = counts
+	}
+	counts[kind]++
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+
+	for _, sanction := range antiCheat.Sanctions {
+		if sanction.Violations != total {
+			continue
+		}
+		switch sanction.Action {
+		case SanctionWarn:
+			s.writeToClient(clientID, fmt.Sprintf("ANTICHEAT WARNING %d violations", total))
+		case SanctionMute:
+			s.limits.Mute(clientID, time.Duration(sanction.Minutes)*time.Minute)
+			s.writeToClient(clientID, fmt.Sprintf("ANTICHEAT MUTED %d", sanction.Minutes*60))
+		case SanctionKick:
+			s.writeToClient(clientID, "ANTICHEAT DISCONNECTED")
+			if conn, online := s.clients[clientID]; online {
+				conn.Close()
+			}
+		}
+		fmt.Printf("Anti-cheat: %s sanctioned with %s\n", clientID, sanction.Action)
+	}
+}
+
+// ownsPokemon reports whether every uid is in user's party, or in their
+// trade escrow when escrowed is set.
+func ownsPokemon(user map[string]interface{}, escrowed bool, uids ...string) bool {
+	party := make(map[string]bool)
+	for _, p := range decodeListPokemon(user["listPokemon"]) {
+		party[p.UID] = true
+	}
+	if escrowed {
+		for _, p := range decodeListPokemon(user["escrow"]) {
+			party[p.UID] = true
+		}
+	}
+	for _, uid := range uids {
+		if !party[uid] {
+			return false
+		}
+	}
+	return true
+}
+
+// validateAction checks a client command against the server's state before
+// it runs. A refused command is recorded as a violation and the client is
+// told ANTICHEAT REJECTED.
+func (s *Server) validateAction(clientID string, parts []string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kind, detail := s.actionViolation(clientID, parts)
+	if kind == "" {
+		return true
+	}
+	s.writeToClient(clientID, "ANTICHEAT REJECTED "+kind)
+	s.recordViolation(clientID, kind, detail)
+	return false
+}
+
+// actionViolation returns the kind of violation parts commits, if any.
+// Caller must hold s.mutex.
+func (s *Server) actionViolation(clientID string, parts []string) (string, string) {
+	var uids []string
+	escrowed := false
+	switch parts[0] {
+	case "THROW":
+		enc, exists := s.encounters[clientID]
+		if !exists {
+			return "", ""
+		}
+		user, err := s.loadUser(clientID)
+		if err != nil {
+			return "", ""
+		}
+		if d := distance(userPosition(user), enc.Position); d > antiCheat.CaptureRange {
+			return ViolationRange, fmt.Sprintf("threw from %d tiles", d)
+		}
+		return "", ""
+	case "BATTLE":
+		if len(parts) > 2 && parts[1] == "SWITCH" {
+			uids = parts[2:3]
+		}
+	case "USE":
+		if len(parts) < 3 {
+			break
+		}
+		if item, ok := lookupItem(parts[1]); ok && (item.Kind == ItemPotion || item.Kind == ItemStone) {
+			uids = parts[2:3]
+		}
+	case "DEPOSIT":
+		uids = parts[1:2]
+	case "TRADE":
+		// A revised offer may keep Pokemon already in escrow.
+		if len(parts) > 3 && parts[1] == "OFFER" {
+			uids, escrowed = parts[3:], true
+		}
+	}
+	if len(uids) == 0 {
+		return "", ""
+	}
+	user, err := s.loadUser(clientID)
+	if err != nil || ownsPokemon(user, escrowed, uids...) {
+		return "", ""
+	}
+	return ViolationPokemon, fmt.Sprintf("%s on %v", parts[0], uids)
+}
+
+// MovePlayer moves clientID to the tile x, y if it is within reach of
+// where the server has them, and replies MOVED or MOVE REJECTED with the
+// authoritative position.
+func (s *Server) MovePlayer(clientID string, xText, yText string) {
+	x, err := strconv.Atoi(xText)
+	y, yErr := strconv.Atoi(yText)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil || yErr != nil {
+		s.writeToClient(clientID, "Usage: MOVE <x> <y>")
+		return
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return
+	}
+	from, to := userPosition(user), Position{X: x, Y: y}
+	d := distance(from, to)
+
+	kind := ""
+	switch {
+	case s.busy(clientID):
+		kind = ViolationFrozen
+	case d > antiCheat.TeleportDistance:
+		kind = ViolationTeleport
+	case d > antiCheat.MaxStep || s.moves[clientID]+d > antiCheat.MovesPerTick:
+		kind = ViolationSpeed
+	}
+	if kind != "" {
+		s.writeToClient(clientID, fmt.Sprintf("MOVE REJECTED %s %d %d", kind, from.X, from.Y))
+		s.recordViolation(clientID, kind, fmt.Sprintf("%d,%d to %d,%d", from.X, from.Y, to.X, to.Y))
+		return
+	}
+	if !onMap(to) {
+		s.writeToClient(clientID, fmt.Sprintf("MOVE REJECTED %s %d %d", moveOffMap, from.X, from.Y))
+		return
+	}
+	if d == 0 {
+		s.writeToClient(clientID, fmt.Sprintf("MOVED %d %d", from.X, from.Y))
+		return
+	}
+
+	s.moves[clientID] += d
+	user["positionX"] = to.X
+	user["positionY"] = to.Y
+	s.walked(clientID, user, from, s.trainerSightings())
+	if err := s.storeClientsData(A); err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	s.writeToClient(clientID, fmt.Sprintf("MOVED %d %d", to.X, to.Y))
+}
+
+// ShowViolationsInConsole prints the violation counts of every player, or
+// of clientID only.
+func (s *Server) ShowViolationsInConsole(clientID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := make([]string, 0, len(s.violations))
+	for id := range s.violations {
+		if clientID == "" || id == clientID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		fmt.Println("No violations")
+		return
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		data, _ := json.Marshal(s.violations[id])
+		fmt.Printf("%s: %s\n", id, data)
+	}
+}
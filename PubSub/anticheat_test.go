@@ -0,0 +1,59 @@
+package PubSub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTradeReofferKeepsEscrowedPokemon(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	s := newTestServer(t)
+	ash := addTestPlayer(t, s, "ash", Position{X: 5, Y: 5}, append(testParty(), Pokemon{UID: "p3", ID: 1, LV: 8}))
+	addTestPlayer(t, s, "misty", Position{X: 5, Y: 5}, testParty())
+
+	offer := func(uids ...string) bool {
+		parts := append([]string{"TRADE", "OFFER", "misty"}, uids...)
+		if !s.validateAction("ash", parts) {
+			return false
+		}
+		s.OfferTrade("ash", ash, "misty", uids)
+		return true
+	}
+	if !offer("p1") {
+		t.Fatal("first offer rejected")
+	}
+	if !offer("p1", "p3") {
+		t.Errorf("re-offer of an escrowed Pokemon rejected: %q", ash.lines())
+	}
+	if len(s.violations["ash"]) != 0 {
+		t.Errorf("violations = %v, want none", s.violations["ash"])
+	}
+	if !strings.HasPrefix(ash.lastLine(), "TRADE OFFERED ") {
+		t.Errorf("reply = %q", ash.lastLine())
+	}
+
+	if offer("p1", "stolen") || s.violations["ash"][ViolationPokemon] != 1 {
+		t.Errorf("offer of a Pokemon ash does not own: violations %v", s.violations["ash"])
+	}
+}
+
+func TestMoveRejectedAtMapEdge(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	s := newTestServer(t)
+	ash := addTestPlayer(t, s, "ash", Position{X: 0, Y: mapSize - 1}, testParty())
+
+	for _, to := range [][2]string{{"-1", "99"}, {"0", "100"}} {
+		s.MovePlayer("ash", to[0], to[1])
+		if got := ash.lastLine(); got != "MOVE REJECTED offmap 0 99" {
+			t.Errorf("move to %v: %q", to, got)
+		}
+	}
+	if len(s.violations["ash"]) != 0 {
+		t.Errorf("violations = %v, want none", s.violations["ash"])
+	}
+
+	s.MovePlayer("ash", "1", "99")
+	if got := ash.lastLine(); got != "MOVED 1 99" {
+		t.Errorf("move along the edge: %q", got)
+	}
+}
@@ -0,0 +1,404 @@
+package PubSub
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	accountsFile      = "accounts.json"
+	tokenKeyFile      = "token.key"
+	tokenTTL          = 24 * time.Hour
+	hashIterations    = 100000
+	saltSize          = 16
+	minPasswordLength = 6
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errInvalidToken       = errors.New("invalid token")
+	errTokenExpired       = errors.New("token expired")
+	errUsernameTaken      = errors.New("username taken")
+	errAlreadyOnline      = errors.New("already logged in")
+
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,20}$`)
+)
+
+// Account is a registered player. PlayerID is the player's clientID in
+// every session, and Player holds their game state between sessions.
+type Account struct {
+	Username string                 `json:"username"`
+	Salt     string                 `json:"salt"`
+	Hash     string                 `json:"hash"`
+	PlayerID string                 `json:"playerID"`
+	Created  time.Time              `json:"created"`
+	Player   map[string]interface{} `json:"player,omitempty"`
+}
+
+type AccountList struct {
+	Accounts []*Account `json:"accounts"`
+}
+
+// tokenClaims is the signed payload of a session token.
+type tokenClaims struct {
+	PlayerID string `json:"sub"`
+	Expires  int64  `json:"exp"`
+}
+
+var (
+	tokenKey     []byte
+	tokenKeyOnce sync.Once
+)
+
+// signingKey returns the token signing key, loading it from tokenKeyFile
+// or creating it on first use so tokens survive restarts.
+func signingKey() []byte {
+	tokenKeyOnce.Do(func() {
+		if data, err := os.ReadFile(tokenKeyFile); err == nil {
+			if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) > 0 {
+				tokenKey = key
+				return
+			}
+		}
+		tokenKey = make([]byte, 32)
+		if _, err := rand.Read(tokenKey); err != nil {
+			panic(fmt.Sprintf("error generating token key: %v", err))
+		}
+		if err := os.WriteFile(tokenKeyFile, []byte(hex.EncodeToString(tokenKey)), 0600); err != nil {
+			fmt.Printf("Error writing token key: %v\n", err)
+		}
+	})
+	return tokenKey
+}
+
+func hashPassword(password string, salt []byte) string {
+	return hex.EncodeToString(pbkdf2.Key([]byte(password), salt, hashIterations, sha256.Size, sha256.New))
+}
+
+func (a *Account) checkPassword(password string) bool {
+	salt, err := hex.DecodeString(a.Salt)
+	if err != nil || a.Hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashPassword(password, salt)), []byte(a.Hash)) == 1
+}
+
+// issueToken signs a session token for playerID that expires after
+// tokenTTL.
+func issueToken(playerID string) string {
+	return signToken(tokenClaims{PlayerID: playerID, Expires: time.Now().Add(tokenTTL).Unix()})
+}
+
+func signToken(c tokenClaims) string {
+	claims, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, signingKey())
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks token's signature and expiry and returns its player.
+func verifyToken(token string) (string, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return "", errInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	mac := hmac.New(sha256.New, signingKey())
+	mac.Write([]byte(payload))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return "", errInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil || claims.PlayerID == "" {
+		return "", errInvalidToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return "", errTokenExpired
+	}
+	return claims.PlayerID, nil
+}
+
+// loadAccounts decodes accountsFile. Caller must hold s.mutex.
+func (s *Server) loadAccounts() (*AccountList, error) {
+	list := &AccountList{}
+	file, err := os.Open(accountsFile)
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening accounts file: %v", err)
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(list); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error decoding accounts file: %v", err)
+	}
+	return list, nil
+}
+
+// storeAccounts writes list to accountsFile. Caller must hold s.mutex.
+func (s *Server) storeAccounts(list *AccountList) error {
+	file, err := os.OpenFile(accountsFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating accounts file: %v", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(list); err != nil {
+		return fmt.Errorf("error encoding accounts file: %v", err)
+	}
+	return nil
+}
+
+func (list *AccountList) find(match func(*Account) bool) *Account {
+	for _, account := range list.Accounts {
+		if match(account) {
+			return account
+		}
+	}
+	return nil
+}
+
+func (s *Server) register(username, password string) (*Account, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, errors.New("username must be 3-20 letters, digits, _ or -")
+	}
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	hash := hashPassword(password, salt)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	list, err := s.loadAccounts()
+	if err != nil {
+		return nil, err
+	}
+	if list.find(func(a *Account) bool { return strings.EqualFold(a.Username, username) }) != nil {
+		return nil, errUsernameTaken
+	}
+	account := &Account{
+		Username: username,
+		Salt:     hex.EncodeToString(salt),
+		Hash:     hash,
+		PlayerID: uuid.New().String(),
+		Created:  time.Now(),
+	}
+	list.Accounts = append(list.Accounts, account)
+	return account, s.storeAccounts(list)
+}
+
+// login checks username's password. Logins for a username or from an
+// address that failed too often recently are refused without checking.
+func (s *Server) login(username, password, address string) (*Account, error) {
+	if wait := s.logins.Locked(username, address); wait > 0 {
+		return nil, fmt.Errorf("too many failed logins, try again in %ds", int(wait.Seconds())+1)
+	}
+	s.mutex.Lock()
+	list, err := s.loadAccounts()
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	account := list.find(func(a *Account) bool { return strings.EqualFold(a.Username, username) })
+	if account == nil {
+		// Hash anyway so unknown names take as long as wrong passwords.
+		hashPassword(password, make([]byte, saltSize))
+		s.logins.Fail(username, address)
+		return nil, errInvalidCredentials
+	}
+	if !account.checkPassword(password) {
+		s.logins.Fail(username, address)
+		return nil, errInvalidCredentials
+	}
+	s.logins.Succeed(username)
+	return account, nil
+}
+
+func (s *Server) resume(token string) (*Account, error) {
+	playerID, err := verifyToken(token)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list, err := s.loadAccounts()
+	if err != nil {
+		return nil, err
+	}
+	account := list.find(func(a *Account) bool { return a.PlayerID == playerID })
+	if account == nil {
+		return nil, errInvalidToken
+	}
+	return account, nil
+}
+
+// certificateAccount returns the account named by a verified client
+// certificate, creating a certificate-only account without a password on
+// first use.
+func (s *Server) certificateAccount(username string) (*Account, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, errors.New("certificate name is not a valid username")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	list, err := s.loadAccounts()
+	if err != nil {
+		return nil, err
+	}
+	if account := list.find(func(a *Account) bool { return strings.EqualFold(a.Username, username) }); account != nil {
+		return account, nil
+	}
+	account := &Account{Username: username, PlayerID: uuid.New().String(), Created: time.Now()}
+	list.Accounts = append(list.Accounts, account)
+	return account, s.storeAccounts(list)
+}
+
+// authenticate logs conn in, by its client certificate when it presents
+// one or else by reading REGISTER, LOGIN and RESUME commands until one
+// succeeds. It adds the account's player and returns their clientID.
+// Every other command is refused, and connection limits how fast
+// attempts may come.
+func (s *Server) authenticate(conn net.Conn, scanner *bufio.Scanner, connection *tokenBucket) (string, bool) {
+	name, err := clientCertificateName(conn)
+	if err != nil {
+		fmt.Printf("TLS handshake failed: %v\n", err)
+		return "", false
+	}
+	if name != "" {
+		account, err := s.certificateAccount(name)
+		if err == nil {
+			err = s.addClient(conn, account.PlayerID, account.Player, createRandomListPokemon(3))
+		}
+		if err == nil {
+			_, _ = conn.Write([]byte(fmt.Sprintf("AUTH OK %s %s %s\n", account.Username, account.PlayerID, issueToken(account.PlayerID))))
+			return account.PlayerID, true
+		}
+		_, _ = conn.Write([]byte("AUTH ERROR " + err.Error() + "\n"))
+	}
+
+	_, _ = conn.Write([]byte("AUTH REQUIRED REGISTER <user> <password>|LOGIN <user> <password>|RESUME <token>\n"))
+	strikes := 0
+	for scanner.Scan() {
+		if !connection.allow(time.Now()) {
+			if strikes++; strikes >= kickStrikes {
+				_, _ = conn.Write([]byte("RATE LIMITED DISCONNECTED\n"))
+				return "", false
+			}
+			_, _ = conn.Write([]byte("RATE LIMITED\n"))
+			continue
+		}
+		parts := strings.SplitN(scanner.Text(), " ", 3)
+
+		var account *Account
+		var err error
+		switch parts[0] {
+		case "REGISTER", "LOGIN":
+			if len(parts) < 3 {
+				_, _ = conn.Write([]byte("Usage: " + parts[0] + " <user> <password>\n"))
+				continue
+			}
+			if parts[0] == "REGISTER" {
+				account, err = s.register(parts[1], parts[2])
+			} else {
+				account, err = s.login(parts[1], parts[2], remoteIP(conn))
+			}
+		case "RESUME":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: RESUME <token>\n"))
+				continue
+			}
+			account, err = s.resume(parts[1])
+		default:
+			_, _ = conn.Write([]byte("AUTH REQUIRED\n"))
+			continue
+		}
+
+		if err == nil {
+			err = s.addClient(conn, account.PlayerID, account.Player, createRandomListPokemon(3))
+		}
+		if err != nil {
+			_, _ = conn.Write([]byte("AUTH ERROR " + err.Error() + "\n"))
+			continue
+		}
+		_, _ = conn.Write([]byte(fmt.Sprintf("AUTH OK %s %s %s\n", account.Username, account.PlayerID, issueToken(account.PlayerID))))
+		return account.PlayerID, true
+	}
+	return "", false
+}
+
+// saveSnapshot copies clientID's game state into their account so it can
+// be restored at the next login.
+func (s *Server) saveSnapshot(clientID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		return
+	}
+	if err := s.storeSnapshots([]interface{}{user}); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// storeSnapshots copies the game state of every user that has an account
+// into it. storeClientsData calls it on every store, so progress survives
+// a crash as well as a logout. Caller must hold s.mutex.
+func (s *Server) storeSnapshots(users []interface{}) error {
+	if len(users) == 0 {
+		return nil
+	}
+	list, err := s.loadAccounts()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, u := range users {
+		user, ok := u.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if account := list.find(func(a *Account) bool { return a.PlayerID == user["uID"] }); account != nil {
+			account.Player = user
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.storeAccounts(list)
+}
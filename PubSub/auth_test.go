@@ -0,0 +1,174 @@
+package PubSub
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSavedWithEveryStore(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	s := newTestServer(t)
+	s.mutex.Lock()
+	if err := s.storeAccounts(&AccountList{Accounts: []*Account{{Username: "ash", PlayerID: "ash"}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Unlock()
+
+	addTestPlayer(t, s, "ash", Position{X: 1, Y: 1}, testParty())
+	credit(t, s, "ash", 250)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list, err := s.loadAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := list.Accounts[0].Player
+	if player == nil || userCounter(player, "balance") != 250 {
+		t.Errorf("snapshot = %v, want balance 250", player)
+	}
+	if _, leaked := player[pendingLedgerKey]; leaked {
+		t.Error("snapshot holds queued ledger entries")
+	}
+}
+
+func TestRebuiltPlayerKeepsLedgerBalance(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	s := newTestServer(t)
+	addTestPlayer(t, s, "ash", Position{X: 1, Y: 1}, testParty())
+	credit(t, s, "ash", 700)
+
+	// The server crashes before ash's state reaches an account.
+	delete(s.clients, "ash")
+	if err := os.WriteFile("clients.json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.addClient(&recordConn{}, "ash", nil, testParty()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addClient(&recordConn{}, "brock", nil, testParty()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := balanceOf(t, s, "ash"); got != 700 {
+		t.Errorf("rebuilt balance = %d, want 700", got)
+	}
+	if sum, entries := ledgerTotal(t, "ash"); sum != 700 || len(entries) != 1 {
+		t.Errorf("ash's ledger: total %d, entries %+v", sum, entries)
+	}
+	s.mutex.Lock()
+	ash, _ := s.loadUser("ash")
+	s.mutex.Unlock()
+	if items := decodeItems(ash["items"]); len(items) != 0 {
+		t.Errorf("rebuilt player got starter items %v", items)
+	}
+
+	if got := balanceOf(t, s, "brock"); got != starterBalance {
+		t.Errorf("new player's balance = %d, want %d", got, starterBalance)
+	}
+	if sum, _ := ledgerTotal(t, "brock"); sum != starterBalance {
+		t.Errorf("new player's ledger total = %d, want %d", sum, starterBalance)
+	}
+}
+
+func TestHashPasswordMatchesStoredHashes(t *testing.T) {
+	// Hashed before the switch to x/crypto; existing accounts must still
+	// log in.
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	if got, want := hashPassword("secretpass1", salt), "49481a7e22635b50808c9218d0947c06b62e11f83bce94e5751a84fa532db95f"; got != want {
+		t.Errorf("hashPassword = %s, want %s", got, want)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	chdirTemp(t)
+	token := issueToken("ash")
+	payload, signature, _ := strings.Cut(token, ".")
+	forged, _ := json.Marshal(tokenClaims{PlayerID: "brock", Expires: time.Now().Add(time.Hour).Unix()})
+	flipped := []byte(signature)
+	if flipped[0] == 'A' {
+		flipped[0] = 'B'
+	} else {
+		flipped[0] = 'A'
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+		err   error
+	}{
+		{"issued", token, "ash", nil},
+		{"no signature", payload, "", errInvalidToken},
+		{"empty", "", "", errInvalidToken},
+		{"tampered payload", base64.RawURLEncoding.EncodeToString(forged) + "." + signature, "", errInvalidToken},
+		{"tampered signature", payload + "." + string(flipped), "", errInvalidToken},
+		{"bad signature encoding", payload + ".!!", "", errInvalidToken},
+		{"expired", signToken(tokenClaims{PlayerID: "ash", Expires: time.Now().Add(-time.Second).Unix()}), "", errTokenExpired},
+		{"no player", signToken(tokenClaims{Expires: time.Now().Add(time.Hour).Unix()}), "", errInvalidToken},
+	}
+	for _, tt := range tests {
+		got, err := verifyToken(tt.token)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: verifyToken = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestLoginLockedAfterFailures(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := s.register("misty", "secretpass1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxAccountLoginFailures; i++ {
+		if _, err := s.login("misty", "wrongpass", "10.0.0.1"); err != errInvalidCredentials {
+			t.Fatalf("attempt %d: err = %v, want %v", i+1, err, errInvalidCredentials)
+		}
+	}
+	// The lock holds for the account from a fresh address and with the
+	// right password.
+	if _, err := s.login("MISTY", "secretpass1", "10.0.0.2"); err == nil || !strings.Contains(err.Error(), "too many failed logins") {
+		t.Errorf("login after %d failures: err = %v, want a lockout", maxAccountLoginFailures, err)
+	}
+}
+
+func TestLoginLimits(t *testing.T) {
+	l := NewLoginLimits()
+	for i := 0; i < maxAddressLoginFailures; i++ {
+		if wait := l.Locked("user"+strconv.Itoa(i), "10.0.0.1"); wait != 0 {
+			t.Fatalf("attempt %d locked for %v", i+1, wait)
+		}
+		l.Fail("user"+strconv.Itoa(i), "10.0.0.1")
+	}
+	if wait := l.Locked("someone", "10.0.0.1"); wait <= 0 || wait > loginFailureWindow {
+		t.Errorf("address after %d failures locked for %v, want up to %v", maxAddressLoginFailures, wait, loginFailureWindow)
+	}
+	if wait := l.Locked("someone", "10.0.0.2"); wait != 0 {
+		t.Errorf("other address locked for %v", wait)
+	}
+
+	for i := 0; i < maxAccountLoginFailures; i++ {
+		l.Fail("misty", "10.0.0.3")
+	}
+	if l.Locked("misty", "10.0.0.4") == 0 {
+		t.Error("account not locked after failures")
+	}
+	l.Succeed("misty")
+	if wait := l.Locked("misty", "10.0.0.4"); wait != 0 {
+		t.Errorf("account locked for %v after a success", wait)
+	}
+
+	// Failures older than the window are forgotten.
+	l.failures[loginAccountKey("misty")] = &loginFailures{count: maxAccountLoginFailures, first: time.Now().Add(-loginFailureWindow)}
+	if wait := l.Locked("misty", "10.0.0.4"); wait != 0 {
+		t.Errorf("account locked for %v after the window", wait)
+	}
+}
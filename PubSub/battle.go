@@ -0,0 +1,515 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+type Move struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Power    int    `json:"power"`
+	Physical bool   `json:"physical"`
+}
+
+var tackle = Move{Name: "Tackle", Type: "normal", Power: 40, Physical: true}
+
+// typeMoves is the signature move each Pokemon learns for each of its types.
+var typeMoves = map[string]Move{
+	"normal":   {Name: "Headbutt", Type: "normal", Power: 70, Physical: true},
+	"fire":     {Name: "Ember", Type: "fire", Power: 40},
+	"water":    {Name: "Water Gun", Type: "water", Power: 40},
+	"grass":    {Name: "Vine Whip", Type: "grass", Power: 45, Physical: true},
+	"electric": {Name: "Thunder Shock", Type: "electric", Power: 40},
+	"ice":      {Name: "Ice Shard", Type: "ice", Power: 40, Physical: true},
+	"fighting": {Name: "Karate Chop", Type: "fighting", Power: 50, Physical: true},
+	"poison":   {Name: "Acid", Type: "poison", Power: 40},
+	"ground":   {Name: "Bulldoze", Type: "ground", Power: 60, Physical: true},
+	"flying":   {Name: "Gust", Type: "flying", Power: 40},
+	"psychic":  {Name: "Confusion", Type: "psychic", Power: 50},
+	"bug":      {Name: "Bug Bite", Type: "bug", Power: 60, Physical: true},
+	"rock":     {Name: "Rock Throw", Type: "rock", Power: 50, Physical: true},
+	"ghost":    {Name: "Shadow Sneak", Type: "ghost", Power: 40, Physical: true},
+	"dragon":   {Name: "Dragon Breath", Type: "dragon", Power: 60},
+	"dark":     {Name: "Bite", Type: "dark", Power: 60, Physical: true},
+	"steel":    {Name: "Metal Claw", Type: "steel", Power: 50, Physical: true},
+	"fairy":    {Name: "Fairy Wind", Type: "fairy", Power: 40},
+}
+
+// typeChart holds every attacking/defending pair that is not neutral.
+var typeChart = map[string]map[string]float64{
+	"normal":   {"rock": 0.5, "ghost": 0, "steel": 0.5},
+	"fire":     {"fire": 0.5, "water": 0.5, "grass": 2, "ice": 2, "bug": 2, "rock": 0.5, "dragon": 0.5, "steel": 2},
+	"water":    {"fire": 2, "water": 0.5, "grass": 0.5, "ground": 2, "rock": 2, "dragon": 0.5},
+	"electric": {"water": 2, "electric": 0.5, "grass": 0.5, "ground": 0, "flying": 2, "dragon": 0.5},
+	"grass":    {"fire": 0.5, "water": 2, "grass": 0.5, "poison": 0.5, "ground": 2, "flying": 0.5, "bug": 0.5, "rock": 2, "dragon": 0.5, "steel": 0.5},
+	"ice":      {"fire": 0.5, "water": 0.5, "grass": 2, "ice": 0.5, "ground": 2, "flying": 2, "dragon": 2, "steel": 0.5},
+	"fighting": {"normal": 2, "ice": 2, "poison": 0.5, "flying": 0.5, "psychic": 0.5, "bug": 0.5, "rock": 2, "ghost": 0, "dark": 2, "steel": 2, "fairy": 0.5},
+	"poison":   {"grass": 2, "poison": 0.5, "ground": 0.5, "rock": 0.5, "ghost": 0.5, "steel": 0, "fairy": 2},
+	"ground":   {"fire": 2, "electric": 2, "grass": 0.5, "poison": 2, "flying": 0, "bug": 0.5, "rock": 2, "steel": 2},
+	"flying":   {"electric": 0.5, "grass": 2, "fighting": 2, "bug": 2, "rock": 0.5, "steel": 0.5},
+	"psychic":  {"fighting": 2, "poison": 2, "psychic": 0.5, "dark": 0, "steel": 0.5},
+	"bug":      {"fire": 0.5, "grass": 2, "fighting": 0.5, "poison": 0.5, "flying": 0.5, "psychic": 2, "ghost": 0.5, "dark": 2, "steel": 0.5, "fairy": 0.5},
+	"rock":     {"fire": 2, "ice": 2, "fighting": 0.5, "ground": 0.5, "flying": 2, "bug": 2, "steel": 0.5},
+	"ghost":    {"normal": 0, "psychic": 2, "ghost": 2, "dark": 0.5},
+	"dragon":   {"dragon": 2, "steel": 0.5, "fairy": 0},
+	"dark":     {"fighting": 0.5, "psychic": 2, "ghost": 2, "dark": 0.5, "fairy": 0.5},
+	"steel":    {"fire": 0.5, "water": 0.5, "electric": 0.5, "ice": 2, "rock": 2, "steel": 0.5, "fairy": 2},
+	"fairy":    {"fire": 0.5, "fighting": 2, "poison": 0.5, "dragon": 2, "dark": 2, "steel": 0.5},
+}
+
+func typeEffectiveness(moveType string, defender []string) float64 {
+	multiplier := 1.0
+	for _, t := range defender {
+		if m, ok := typeChart[moveType][t]; ok {
+			multiplier *= m
+		}
+	}
+	return multiplier
+}
+
+// Battler is a Pokemon with the stats and HP it has for one battle.
+type Battler struct {
+	Pokemon Pokemon   `json:"pokemon"`
+	Types   []string  `json:"types"`
+	Stats   BaseStats `json:"stats"`
+	HP      int       `json:"hp"`
+	Moves   []Move    `json:"moves"`
+}
+
+func calcStat(base, level int) int {
+	return 2*base*level/100 + 5
+}
+
+func newBattler(p Pokemon) *Battler {
+	base := BaseStats{HP: 50, Attack: 50, Defense: 50, SpAttack: 50, SpDefense: 50, Speed: 50}
+	types := []string{"normal"}
+	if sp, ok := lookupSpecies(p.ID); ok {
+		base = sp.BaseStats
+		types = sp.Types
+	}
+
+	b := &Battler{
+		Pokemon: p,
+		Types:   types,
+		Stats: BaseStats{
+			HP:        2*base.HP*p.LV/100 + p.LV + 10,
+			Attack:    calcStat(base.Attack, p.LV),
+			Defense:   calcStat(base.Defense, p.LV),
+			SpAttack:  calcStat(base.SpAttack, p.LV),
+			SpDefense: calcStat(base.SpDefense, p.LV),
+			Speed:     calcStat(base.Speed, p.LV),
+		},
+		Moves: []Move{tackle},
+	}
+	b.HP = b.Stats.HP
+	for _, t := range types {
+		if move, ok := typeMoves[t]; ok {
+			b.Moves = append(b.Moves, move)
+		}
+	}
+	return b
+}
+
+func (b *Battler) fainted() bool {
+	return b.HP <= 0
+}
+
+const (
+	BattleOngoing = ""
+	BattleWon     = "WON"
+	BattleLost    = "LOST"
+	BattleFled    = "FLED"
+)
+
+// Battle is a single-player fight against one wild Pokemon or a trainer's
+// team, in which case Wild is the trainer's active Pokemon. All randomness
+// comes from rng, so a battle replays identically for the same seed and
+// commands.
+type Battle struct {
+	rng          *rand.Rand
+	Party        []*Battler `json:"party"`
+	Active       int        `json:"active"`
+	Wild         *Battler   `json:"wild"`
+	Trainer      string     `json:"trainer,omitempty"`
+	Team         []*Battler `json:"team,omitempty"`
+	Result       string     `json:"result"`
+	fleeAttempts int
+}
+
+var (
+	errBattleOver    = errors.New("battle is over")
+	errInvalidMove   = errors.New("invalid move")
+	errInvalidSwitch = errors.New("invalid switch")
+	errNoPokemon     = errors.New("no Pokemon able to battle")
+	errTrainerBattle = errors.New("cannot flee a trainer battle")
+)
+
+func NewBattle(party []Pokemon, wild Pokemon, seed int64) (*Battle, error) {
+	b := &Battle{
+		rng:    rand.New(rand.NewSource(seed)),
+		Wild:   newBattler(wild),
+		Active: -1,
+	}
+	for _, p := range party {
+		b.Party = append(b.Party, newBattler(p))
+	}
+	if len(b.Party) == 0 {
+		return nil, errNoPokemon
+	}
+	b.Active = 0
+	return b, nil
+}
+
+// NewTrainerBattle starts a fight against trainerID, who sends out team in
+// order.
+func NewTrainerBattle(party, team []Pokemon, trainerID string, seed int64) (*Battle, error) {
+	if len(team) == 0 {
+		return nil, errNoPokemon
+	}
+	b, err := NewBattle(party, team[0], seed)
+	if err != nil {
+		return nil, err
+	}
+	b.Trainer = trainerID
+	b.Team = []*Battler{b.Wild}
+	for _, p := range team[1:] {
+		b.Team = append(b.Team, newBattler(p))
+	}
+	return b, nil
+}
+
+// nextOpponent sends out the trainer's next healthy Pokemon and reports
+// whether one was left.
+func (b *Battle) nextOpponent() bool {
+	for _, battler := range b.Team {
+		if !battler.fainted() {
+			b.Wild = battler
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Battle) active() *Battler {
+	return b.Party[b.Active]
+}
+
+// damage computes the HP attacker's move takes from defender.
+func damage(rng *rand.Rand, attacker, defender *Battler, move Move) (int, float64) {
+	atk, def := attacker.Stats.SpAttack, defender.Stats.SpDefense
+	if move.Physical {
+		atk, def = attacker.Stats.Attack, defender.Stats.Defense
+	}
+	if def < 1 {
+		def = 1
+	}
+
+	effectiveness := typeEffectiveness(move.Type, defender.Types)
+	dmg := float64((2*attacker.Pokemon.LV/5+2)*move.Power*atk/def)/50 + 2
+	for _, t := range attacker.Types {
+		if t == move.Type {
+			dmg *= 1.5 // same-type attack bonus
+			break
+		}
+	}
+	dmg *= effectiveness
+	dmg *= float64(85+rng.Intn(16)) / 100
+	if effectiveness > 0 && dmg < 1 {
+		dmg = 1
+	}
+	return int(dmg), effectiveness
+}
+
+// attack applies move to defender and describes it as seen by side.
+func attack(rng *rand.Rand, attacker, defender *Battler, move Move, side string) string {
+	dmg, effectiveness := damage(rng, attacker, defender, move)
+	defender.HP -= dmg
+	if defender.HP < 0 {
+		defender.HP = 0
+	}
+	event := fmt.Sprintf("BATTLE %s %s used %s for %d (HP %d/%d)", side, attacker.Pokemon.UID, move.Name, dmg, defender.HP, defender.Stats.HP)
+	switch {
+	case effectiveness == 0:
+		event += " no effect"
+	case effectiveness > 1:
+		event += " super effective"
+	case effectiveness < 1:
+		event += " not very effective"
+	}
+	return event
+}
+
+func (b *Battle) wildTurn() []string {
+	side := "WILD"
+	if b.Trainer != "" {
+		side = "TRAINER"
+	}
+	move := b.Wild.Moves[b.rng.Intn(len(b.Wild.Moves))]
+	events := []string{attack(b.rng, b.Wild, b.active(), move, side)}
+	if b.active().fainted() {
+		events = append(events, "BATTLE FAINTED "+b.active().Pokemon.UID)
+		events = append(events, b.replaceFainted()...)
+	}
+	return events
+}
+
+// replaceFainted sends out the next healthy party member or ends the
+// battle as lost.
+func (b *Battle) replaceFainted() []string {
+	for i, battler := range b.Party {
+		if !battler.fainted() {
+			b.Active = i
+			return []string{"BATTLE SENT " + battler.Pokemon.UID}
+		}
+	}
+	b.Result = BattleLost
+	return []string{"BATTLE " + BattleLost}
+}
+
+// Move plays one turn in which the active Pokemon uses move n (1-based).
+// The faster Pokemon acts first.
+func (b *Battle) Move(n int) ([]string, error) {
+	if b.Result != BattleOngoing {
+		return nil, errBattleOver
+	}
+	if n < 1 || n > len(b.active().Moves) {
+		return nil, errInvalidMove
+	}
+	move := b.active().Moves[n-1]
+
+	var events []string
+	playerFirst := b.active().Stats.Speed >= b.Wild.Stats.Speed
+	if !playerFirst {
+		events = append(events, b.wildTurn()...)
+		if b.Result != BattleOngoing {
+			return events, nil
+		}
+	}
+
+	events = append(events, attack(b.rng, b.active(), b.Wild, move, "PLAYER"))
+	if b.Wild.fainted() {
+		events = append(events, "BATTLE FAINTED "+b.Wild.Pokemon.UID)
+		if b.nextOpponent() {
+			// The replacement does not act this turn.
+			return append(events, "BATTLE SENT TRAINER "+b.Wild.Pokemon.UID), nil
+		}
+		b.Result = BattleWon
+		return append(events, "BATTLE "+BattleWon), nil
+	}
+
+	if playerFirst {
+		events = append(events, b.wildTurn()...)
+	}
+	return events, nil
+}
+
+// Switch swaps the active Pokemon for party member uid. The wild Pokemon
+// attacks the newcomer.
+func (b *Battle) Switch(uid string) ([]string, error) {
+	if b.Result != BattleOngoing {
+		return nil, errBattleOver
+	}
+	for i, battler := range b.Party {
+		if battler.Pokemon.UID != uid {
+			continue
+		}
+		if i == b.Active || battler.fainted() {
+			return nil, errInvalidSwitch
+		}
+		b.Active = i
+		events := []string{"BATTLE SENT " + uid}
+		return append(events, b.wildTurn()...), nil
+	}
+	return nil, errInvalidSwitch
+}
+
+// Heal restores up to amount HP to party member uid, or the active
+// Pokemon when uid is empty. Using an item takes the turn.
+func (b *Battle) Heal(uid string, amount int) ([]string, error) {
+	if b.Result != BattleOngoing {
+		return nil, errBattleOver
+	}
+	target := b.active()
+	if uid != "" {
+		target = nil
+		for _, battler := range b.Party {
+			if battler.Pokemon.UID == uid {
+				target = battler
+			}
+		}
+	}
+	if target == nil || target.fainted() || target.HP == target.Stats.HP {
+		return nil, errors.New("no effect")
+	}
+
+	target.HP += amount
+	if target.HP > target.Stats.HP {
+		target.HP = target.Stats.HP
+	}
+	events := []string{fmt.Sprintf("BATTLE HEALED %s (HP %d/%d)", target.Pokemon.UID, target.HP, target.Stats.HP)}
+	return append(events, b.wildTurn()...), nil
+}
+
+// Flee tries to escape. Each failed attempt makes the next more likely and
+// gives the wild Pokemon a free attack.
+func (b *Battle) Flee() ([]string, error) {
+	if b.Result != BattleOngoing {
+		return nil, errBattleOver
+	}
+	if b.Trainer != "" {
+		return nil, errTrainerBattle
+	}
+	b.fleeAttempts++
+	wildSpeed := b.Wild.Stats.Speed
+	if wildSpeed < 1 {
+		wildSpeed = 1
+	}
+	odds := b.active().Stats.Speed*128/wildSpeed + 30*b.fleeAttempts
+	if odds > 255 || b.rng.Intn(256) < odds {
+		b.Result = BattleFled
+		return []string{"BATTLE " + BattleFled}, nil
+	}
+	events := []string{"BATTLE FLEE FAILED"}
+	return append(events, b.wildTurn()...), nil
+}
+
+// hpFactor is the capture bonus for a weakened wild Pokemon, from 1 at
+// full HP up to 3 near zero.
+func (b *Battle) hpFactor() float64 {
+	maxHP := float64(b.Wild.Stats.HP)
+	return 3 * maxHP / (maxHP + 2*float64(b.Wild.HP))
+}
+
+// StartBattle begins a battle between the client's party and the wild
+// Pokemon of their open encounter.
+func (s *Server) StartBattle(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	enc, exists := s.encounters[clientID]
+	if !exists {
+		_, _ = conn.Write([]byte("NO ENCOUNTER\n"))
+		return
+	}
+	if s.inBattle(clientID) {
+		_, _ = conn.Write([]byte("BATTLE ALREADY STARTED\n"))
+		return
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return
+	}
+
+	battle, err := NewBattle(decodeListPokemon(user["listPokemon"]), enc.Pokemon, time.Now().UnixNano())
+	if err != nil {
+		_, _ = conn.Write([]byte("BATTLE ERROR " + err.Error() + "\n"))
+		return
+	}
+	s.battles[clientID] = battle
+
+	data, _ := json.Marshal(battle)
+	_, _ = conn.Write([]byte("BATTLE STARTED " + string(data) + "\n"))
+}
+
+// HandleBattleCommand runs BATTLE MOVE/SWITCH/FLEE for the client.
+func (s *Server) HandleBattleCommand(clientID string, conn net.Conn, action, arg string) {
+	s.mutex.Lock()
+	_, pvp := s.pvpBattles[clientID]
+	s.mutex.Unlock()
+	if pvp {
+		s.HandlePvPCommand(clientID, conn, action, arg)
+		return
+	}
+
+	events, result, err := s.playBattleTurn(clientID, action, arg)
+	if err != nil {
+		_, _ = conn.Write([]byte("BATTLE ERROR " + err.Error() + "\n"))
+		return
+	}
+	for _, event := range events {
+		_, _ = conn.Write([]byte(event + "\n"))
+	}
+	if result != BattleOngoing {
+		s.PublishMessage(worldEventsChannel, fmt.Sprintf("BATTLE %s %s", result, clientID))
+	}
+}
+
+func (s *Server) playBattleTurn(clientID, action, arg string) ([]string, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	battle, exists := s.battles[clientID]
+	if !exists {
+		return nil, "", errors.New("no battle")
+	}
+
+	var events []string
+	var err error
+	switch action {
+	case "MOVE":
+		n, convErr := strconv.Atoi(arg)
+		if convErr != nil {
+			return nil, "", errInvalidMove
+		}
+		events, err = battle.Move(n)
+	case "SWITCH":
+		events, err = battle.Switch(arg)
+	case "FLEE":
+		events, err = battle.Flee()
+	default:
+		return nil, "", errors.New("unknown battle action " + action)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if battle.Result != BattleOngoing {
+		s.finishBattle(clientID, battle)
+	}
+	return events, battle.Result, nil
+}
+
+// finishBattle closes the battle and its encounter. A win awards EXP to
+// the active Pokemon and removes the defeated wild Pokemon from the world.
+// Caller must hold s.mutex.
+func (s *Server) finishBattle(clientID string, battle *Battle) {
+	delete(s.battles, clientID)
+	delete(s.encounters, clientID)
+	if battle.Result != BattleWon {
+		return
+	}
+	if battle.Trainer != "" {
+		s.defeatTrainer(clientID, battle)
+		return
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	if user := findUser(A, clientID); user != nil {
+		s.awardExp(user, battle.active().Pokemon.UID, expYield(battle.Wild.Pokemon))
+		s.reward(user, battleRewardPerL*battle.Wild.Pokemon.LV, "battle "+battle.Wild.Pokemon.UID)
+		s.emitGameEvent(user, GameEvent{Type: EventBattleWon, SpeciesID: battle.Wild.Pokemon.ID})
+		if err := s.storeClientsData(A); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	}
+
+	if err := removeWildPokemon(battle.Wild.Pokemon.UID); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
@@ -0,0 +1,229 @@
+package PubSub
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// useSpecies replaces the species catalog for the length of the test.
+func useSpecies(t *testing.T, species ...Species) {
+	t.Helper()
+	saved := speciesCatalog
+	speciesCatalog = make(map[int]Species, len(species))
+	for _, sp := range species {
+		speciesCatalog[sp.ID] = sp
+	}
+	t.Cleanup(func() { speciesCatalog = saved })
+}
+
+var (
+	testBulbasaur  = Species{ID: 1, Name: "Bulbasaur", Types: []string{"grass", "poison"}, BaseStats: BaseStats{HP: 45, Attack: 49, Defense: 49, SpAttack: 65, SpDefense: 65, Speed: 45}}
+	testCharmander = Species{ID: 4, Name: "Charmander", Types: []string{"fire"}, BaseStats: BaseStats{HP: 39, Attack: 52, Defense: 43, SpAttack: 60, SpDefense: 50, Speed: 65}}
+	testSquirtle   = Species{ID: 7, Name: "Squirtle", Types: []string{"water"}, BaseStats: BaseStats{HP: 44, Attack: 48, Defense: 65, SpAttack: 50, SpDefense: 64, Speed: 43}}
+)
+
+func testParty() []Pokemon {
+	return []Pokemon{
+		{UID: "p1", ID: 4, LV: 12},
+		{UID: "p2", ID: 7, LV: 10},
+	}
+}
+
+// playOut moves with the first move until the battle ends and returns
+// every event.
+func playOut(t *testing.T, b *Battle) []string {
+	t.Helper()
+	var events []string
+	for turn := 0; b.Result == BattleOngoing; turn++ {
+		if turn == 100 {
+			t.Fatal("battle did not end in 100 turns")
+		}
+		turnEvents, err := b.Move(1)
+		if err != nil {
+			t.Fatalf("Move: %v", err)
+		}
+		events = append(events, turnEvents...)
+	}
+	return events
+}
+
+func TestBattleReplaysForSameSeed(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	wild := Pokemon{UID: "w1", ID: 1, LV: 11}
+
+	first, err := NewBattle(testParty(), wild, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewBattle(testParty(), wild, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := playOut(t, first)
+	got := playOut(t, second)
+	if len(want) == 0 {
+		t.Fatal("no events")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("same seed gave different events:\n%q\n%q", want, got)
+	}
+	if first.Result != second.Result {
+		t.Errorf("results %s and %s differ", first.Result, second.Result)
+	}
+}
+
+func TestTypeEffectiveness(t *testing.T) {
+	tests := []struct {
+		move     string
+		defender []string
+		want     float64
+	}{
+		{"water", []string{"fire"}, 2},
+		{"fire", []string{"water"}, 0.5},
+		{"fire", []string{"normal"}, 1},
+		{"electric", []string{"ground"}, 0},
+		{"normal", []string{"ghost"}, 0},
+		{"grass", []string{"water", "ground"}, 4},
+		{"fire", []string{"grass", "poison"}, 2},
+		{"ice", []string{"fire", "water"}, 0.25},
+	}
+	for _, tt := range tests {
+		if got := typeEffectiveness(tt.move, tt.defender); got != tt.want {
+			t.Errorf("typeEffectiveness(%s, %v) = %v, want %v", tt.move, tt.defender, got, tt.want)
+		}
+	}
+}
+
+func TestMoveRejectsInvalidMove(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	b, err := NewBattle(testParty(), Pokemon{UID: "w1", ID: 1, LV: 5}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, len(b.active().Moves) + 1} {
+		if _, err := b.Move(n); !errors.Is(err, errInvalidMove) {
+			t.Errorf("Move(%d) error = %v, want %v", n, err, errInvalidMove)
+		}
+	}
+}
+
+func TestSwitchErrors(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	b, err := NewBattle(append(testParty(), Pokemon{UID: "p3", ID: 1, LV: 8}), Pokemon{UID: "w1", ID: 1, LV: 5}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Party[2].HP = 0
+
+	for _, uid := range []string{"p1", "p3", "missing"} {
+		if _, err := b.Switch(uid); !errors.Is(err, errInvalidSwitch) {
+			t.Errorf("Switch(%s) error = %v, want %v", uid, err, errInvalidSwitch)
+		}
+	}
+
+	events, err := b.Switch("p2")
+	if err != nil {
+		t.Fatalf("Switch(p2): %v", err)
+	}
+	if b.Active != 1 || len(events) == 0 || events[0] != "BATTLE SENT p2" {
+		t.Errorf("Switch(p2) active = %d, events = %q", b.Active, events)
+	}
+
+	b.Result = BattleWon
+	if _, err := b.Switch("p1"); !errors.Is(err, errBattleOver) {
+		t.Errorf("Switch after the battle error = %v, want %v", err, errBattleOver)
+	}
+}
+
+func TestFleeErrors(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	team := []Pokemon{{UID: "t1", ID: 7, LV: 10}}
+	b, err := NewTrainerBattle(testParty(), team, "youngster", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Flee(); !errors.Is(err, errTrainerBattle) {
+		t.Errorf("Flee from a trainer error = %v, want %v", err, errTrainerBattle)
+	}
+
+	wild, err := NewBattle(testParty(), Pokemon{UID: "w1", ID: 1, LV: 5}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wild.Result = BattleLost
+	if _, err := wild.Flee(); !errors.Is(err, errBattleOver) {
+		t.Errorf("Flee after the battle error = %v, want %v", err, errBattleOver)
+	}
+}
+
+func TestFleeReplaysForSameSeed(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	flee := func() []string {
+		b, err := NewBattle([]Pokemon{{UID: "p1", ID: 7, LV: 5}}, Pokemon{UID: "w1", ID: 4, LV: 30}, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []string
+		for b.Result == BattleOngoing {
+			turnEvents, err := b.Flee()
+			if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, turnEvents...)
+		}
+		return events
+	}
+	if first, second := flee(), flee(); !reflect.DeepEqual(first, second) {
+		t.Errorf("same seed gave different flee attempts:\n%q\n%q", first, second)
+	}
+}
+
+func TestNextOpponent(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	team := []Pokemon{{UID: "t1", ID: 1, LV: 5}, {UID: "t2", ID: 7, LV: 6}}
+	b, err := NewTrainerBattle(testParty(), team, "youngster", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Wild.Pokemon.UID != "t1" {
+		t.Fatalf("first opponent = %s, want t1", b.Wild.Pokemon.UID)
+	}
+
+	b.Team[0].HP = 0
+	if !b.nextOpponent() || b.Wild.Pokemon.UID != "t2" {
+		t.Errorf("after t1 fainted: opponent = %s, want t2", b.Wild.Pokemon.UID)
+	}
+	b.Team[1].HP = 0
+	if b.nextOpponent() {
+		t.Error("nextOpponent found a Pokemon after the whole team fainted")
+	}
+
+	if _, err := NewTrainerBattle(testParty(), nil, "youngster", 1); !errors.Is(err, errNoPokemon) {
+		t.Errorf("NewTrainerBattle without a team error = %v, want %v", err, errNoPokemon)
+	}
+}
+
+func TestTrainerBattleSendsNextPokemon(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	team := []Pokemon{{UID: "t1", ID: 1, LV: 2}, {UID: "t2", ID: 1, LV: 2}}
+	b, err := NewTrainerBattle([]Pokemon{{UID: "p1", ID: 4, LV: 50}}, team, "youngster", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := playOut(t, b)
+	want := []string{"BATTLE FAINTED t1", "BATTLE SENT TRAINER t2", "BATTLE FAINTED t2", "BATTLE WON"}
+	var got []string
+	for _, event := range events {
+		for _, w := range want {
+			if event == w {
+				got = append(got, event)
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) || b.Result != BattleWon {
+		t.Errorf("events = %q, result %s", events, b.Result)
+	}
+}
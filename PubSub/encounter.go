@@ -0,0 +1,206 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+)
+
+const worldEventsChannel = "world-events"
+
+// Encounter is an open meeting between a player and a wild Pokemon that
+// is resolved by THROW or RUN.
+type Encounter struct {
+	Pokemon  Pokemon  `json:"pokemon"`
+	Position Position `json:"position"`
+	Throws   int      `json:"throws"`
+}
+
+// captureChance returns the probability in [0, 1] that a ball with the
+// given modifier catches p. The species catch rate sets the baseline and
+// higher levels and stronger EVs resist capture.
+func captureChance(p Pokemon, modifier float64) float64 {
+	catchRate := 255
+	if sp, ok := lookupSpecies(p.ID); ok {
+		catchRate = sp.CatchRate
+	}
+	chance := float64(catchRate) / 255 * (1 - float64(p.LV)/float64(p.LV+10)) * (1.5 - p.EV) * modifier
+	if chance > 1 {
+		return 1
+	}
+	if chance < 0 {
+		return 0
+	}
+	return chance
+}
+
+// DetectEncounters starts an encounter for every connected player standing
+// on the same tile as a wild Pokemon that nobody else is engaging.
+func (s *Server) DetectEncounters() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	pokemonWorldList, err := loadPokemonWorld()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	engaged := make(map[string]bool)
+	for _, enc := range s.encounters {
+		engaged[enc.Pokemon.UID] = true
+	}
+
+	for clientID, conn := range s.clients {
+		if s.busy(clientID) {
+			continue
+		}
+		user := findUser(A, clientID)
+		if user == nil || userCounter(user, "repelSteps") > 0 {
+			continue
+		}
+		userPosX := int(user["positionX"].(float64))
+		userPosY := int(user["positionY"].(float64))
+
+		for _, pokemonWorld := range pokemonWorldList.PokemonWorlds {
+			if engaged[pokemonWorld.Pokemon.UID] {
+				continue
+			}
+			if pokemonWorld.Position.X != userPosX || pokemonWorld.Position.Y != userPosY {
+				continue
+			}
+
+			enc := &Encounter{Pokemon: pokemonWorld.Pokemon, Position: pokemonWorld.Position}
+			s.encounters[clientID] = enc
+			engaged[pokemonWorld.Pokemon.UID] = true
+
+			data, _ := json.Marshal(enc.Pokemon)
+			if _, err := conn.Write([]byte("ENCOUNTER " + string(data) + "\n")); err != nil {
+				fmt.Printf("Error sending encounter to client %s: %v\n", clientID, err)
+			}
+			break
+		}
+	}
+}
+
+// ThrowBall resolves one capture attempt in the client's open encounter.
+func (s *Server) ThrowBall(clientID string, conn net.Conn, ballType string) {
+	reply, event := s.resolveThrow(clientID, strings.ToLower(ballType))
+	_, _ = conn.Write([]byte(reply + "\n"))
+	if event != "" {
+		s.PublishMessage(worldEventsChannel, event)
+	}
+}
+
+func (s *Server) resolveThrow(clientID, ballType string) (reply, event string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	enc, exists := s.encounters[clientID]
+	if !exists {
+		return "NO ENCOUNTER", ""
+	}
+	ball, ok := lookupItem(ballType)
+	if !ok || ball.Kind != ItemBall {
+		return "UNKNOWN BALL " + ballType, ""
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return "CAPTURE ERROR", ""
+	}
+	user := findUser(A, clientID)
+	if user == nil || collectionFull(user) {
+		return "CAPTURE REFUSED " + errStorageFull.Error(), ""
+	}
+	if err := takeItem(user, ball.ID, 1); err != nil {
+		return "CAPTURE REFUSED " + err.Error(), ""
+	}
+	if err := s.storeClientsData(A); err != nil {
+		fmt.Printf("%v\n", err)
+		return "CAPTURE ERROR", ""
+	}
+
+	chance := captureChance(enc.Pokemon, ball.CatchModifier)
+	if battle, inBattle := s.battles[clientID]; inBattle {
+		chance *= battle.hpFactor()
+	}
+
+	enc.Throws++
+	if rand.Float64() >= chance {
+		return "CAPTURE FAILED " + enc.Pokemon.UID,
+			fmt.Sprintf("ESCAPED %s %d %s", clientID, enc.Pokemon.ID, enc.Pokemon.UID)
+	}
+
+	where, err := s.capturePokemon(clientID, enc.Pokemon)
+	if err != nil {
+		fmt.Printf("Error capturing Pokemon: %v\n", err)
+		return "CAPTURE ERROR", ""
+	}
+	delete(s.encounters, clientID)
+	delete(s.battles, clientID)
+
+	data, _ := json.Marshal(enc.Pokemon)
+	return "CAPTURE SUCCESS " + where + " " + string(data),
+		fmt.Sprintf("CAPTURED %s %d %s", clientID, enc.Pokemon.ID, enc.Pokemon.UID)
+}
+
+// capturePokemon moves p from the world into the client's party, or
+// storage when the party is full, and returns where it went. Caller must
+// hold s.mutex.
+func (s *Server) capturePokemon(clientID string, p Pokemon) (string, error) {
+	A, err := s.loadClientsData()
+	if err != nil {
+		return "", err
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return "", fmt.Errorf("client %s not found", clientID)
+	}
+
+	s.awardExp(user, "", expYield(p))
+	where, err := addToCollection(user, p)
+	if err != nil {
+		return "", err
+	}
+	s.reward(user, captureReward, "capture "+p.UID)
+	s.registerCaught(user, p.ID)
+	s.leaderboards.Max(BoardLevel, clientID, p.LV)
+	s.emitGameEvent(user, GameEvent{Type: EventCapture, SpeciesID: p.ID})
+	if err := s.storeClientsData(A); err != nil {
+		return "", err
+	}
+	return where, removeWildPokemon(p.UID)
+}
+
+// RunFromEncounter abandons the client's open encounter, leaving the wild
+// Pokemon where it is.
+func (s *Server) RunFromEncounter(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	enc, exists := s.encounters[clientID]
+	_, inBattle := s.battles[clientID]
+	if !inBattle {
+		delete(s.encounters, clientID)
+	}
+	s.mutex.Unlock()
+
+	if inBattle {
+		_, _ = conn.Write([]byte("IN BATTLE use BATTLE FLEE\n"))
+		return
+	}
+	if !exists {
+		_, _ = conn.Write([]byte("NO ENCOUNTER\n"))
+		return
+	}
+	_, _ = conn.Write([]byte("RUN OK\n"))
+	s.PublishMessage(worldEventsChannel, fmt.Sprintf("RAN %s %d %s", clientID, enc.Pokemon.ID, enc.Pokemon.UID))
+}
@@ -0,0 +1,155 @@
+package PubSub
+
+import (
+	"fmt"
+)
+
+const (
+	maxLevel   = 100
+	walkExp    = 1 // EXP the lead Pokemon earns per tile walked
+	minExpGain = 1
+)
+
+// expForLevel returns the total EXP a Pokemon with the given growth rate
+// needs to reach level.
+func expForLevel(growthRate string, level int) int {
+	if level <= 1 {
+		return 0
+	}
+	n := level
+	switch growthRate {
+	case "fast":
+		return 4 * n * n * n / 5
+	case "medium-slow":
+		exp := 6*n*n*n/5 - 15*n*n + 100*n - 140
+		if exp < 0 {
+			return 0
+		}
+		return exp
+	case "slow":
+		return 5 * n * n * n / 4
+	default: // medium-fast
+		return n * n * n
+	}
+}
+
+// levelForExp returns the highest level whose threshold exp has reached.
+func levelForExp(growthRate string, exp int) int {
+	level := 1
+	for level < maxLevel && expForLevel(growthRate, level+1) <= exp {
+		level++
+	}
+	return level
+}
+
+func growthRateOf(id int) string {
+	if sp, ok := lookupSpecies(id); ok {
+		return sp.GrowthRate
+	}
+	return "medium-fast"
+}
+
+// expYield is the EXP earned for defeating or catching p. Without base
+// experience data it is derived from the species' base stat total.
+func expYield(p Pokemon) int {
+	base := 60
+	if sp, ok := lookupSpecies(p.ID); ok {
+		st := sp.BaseStats
+		base = (st.HP + st.Attack + st.Defense + st.SpAttack + st.SpDefense + st.Speed) / 5
+	}
+	exp := base * p.LV / 7
+	if exp < minExpGain {
+		return minExpGain
+	}
+	return exp
+}
+
+// gainExp adds amount EXP to p, raising its level and evolving it when a
+// level threshold is reached. It returns the LEVELUP and EVOLVED events
+// that were triggered.
+func gainExp(p *Pokemon, amount int) []string {
+	var events []string
+
+	// Pokemon spawned before EXP tracking start at zero EXP for their level.
+	if floor := expForLevel(growthRateOf(p.ID), p.LV); p.Exp < floor {
+		p.Exp = floor
+	}
+	p.Exp += amount
+
+	newLevel := levelForExp(growthRateOf(p.ID), p.Exp)
+	if newLevel <= p.LV {
+		return events
+	}
+	p.LV = newLevel
+	events = append(events, fmt.Sprintf("LEVELUP %s %d", p.UID, p.LV))
+
+	// A big gain can pass several evolution levels at once, e.g. a
+	// Charmander reaching 36 evolves twice. seen guards against cycles in
+	// the catalog.
+	seen := map[int]bool{p.ID: true}
+	for {
+		evo, ok := levelEvolution(p)
+		if !ok || seen[evo.ID] {
+			return events
+		}
+		seen[evo.ID] = true
+		events = append(events, evolve(p, evo.ID))
+	}
+}
+
+// levelEvolution returns the first evolution of p's species that its
+// level allows.
+func levelEvolution(p *Pokemon) (Evolution, bool) {
+	if sp, ok := lookupSpecies(p.ID); ok {
+		for _, evo := range sp.EvolvesTo {
+			if evo.Level > 0 && p.LV >= evo.Level {
+				return evo, true
+			}
+		}
+	}
+	return Evolution{}, false
+}
+
+// evolve turns p into species id and returns the EVOLVED event.
+func evolve(p *Pokemon, id int) string {
+	from := p.ID
+	p.ID = id
+	return fmt.Sprintf("EVOLVED %s %d %d", p.UID, from, id)
+}
+
+// awardExp gives amount EXP to the Pokemon uid owned by user, or to the
+// lead Pokemon when uid is empty, and pushes the resulting events to the
+// owning client. Caller must hold s.mutex and persist user.
+func (s *Server) awardExp(user map[string]interface{}, uid string, amount int) {
+	listPokemon := decodeListPokemon(user["listPokemon"])
+	if len(listPokemon) == 0 {
+		return
+	}
+
+	index := 0
+	if uid != "" {
+		index = -1
+		for i := range listPokemon {
+			if listPokemon[i].UID == uid {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return
+		}
+	}
+
+	speciesID := listPokemon[index].ID
+	events := gainExp(&listPokemon[index], amount)
+	user["listPokemon"] = listPokemon
+	if listPokemon[index].ID != speciesID {
+		s.registerCaught(user, listPokemon[index].ID)
+	}
+
+	clientID, _ := user["uID"].(string)
+	s.leaderboards.Max(BoardLevel, clientID, listPokemon[index].LV)
+	for _, event := range events {
+		s.writeToClient(clientID, event)
+	}
+}
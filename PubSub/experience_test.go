@@ -0,0 +1,34 @@
+package PubSub
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGainExpEvolvesThroughChain(t *testing.T) {
+	charmander := testCharmander
+	charmander.EvolvesTo = []Evolution{{ID: 5, Level: 16}}
+	charmeleon := Species{ID: 5, Name: "Charmeleon", Types: []string{"fire"}, EvolvesTo: []Evolution{{ID: 6, Level: 36}}}
+	charizard := Species{ID: 6, Name: "Charizard", Types: []string{"fire", "flying"}}
+	useSpecies(t, charmander, charmeleon, charizard)
+
+	p := &Pokemon{UID: "p1", ID: 4, LV: 10}
+	events := gainExp(p, expForLevel(growthRateOf(4), 36))
+	want := []string{"LEVELUP p1 36", "EVOLVED p1 4 5", "EVOLVED p1 5 6"}
+	if !reflect.DeepEqual(events, want) || p.ID != 6 {
+		t.Errorf("events = %q, species %d, want %q and species 6", events, p.ID, want)
+	}
+}
+
+func TestGainExpStopsOnEvolutionCycle(t *testing.T) {
+	a := Species{ID: 1, Name: "A", EvolvesTo: []Evolution{{ID: 2, Level: 5}}}
+	b := Species{ID: 2, Name: "B", EvolvesTo: []Evolution{{ID: 1, Level: 5}}}
+	useSpecies(t, a, b)
+
+	p := &Pokemon{UID: "p1", ID: 1, LV: 1}
+	events := gainExp(p, expForLevel(growthRateOf(1), 10))
+	want := []string{"LEVELUP p1 10", "EVOLVED p1 1 2"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
@@ -0,0 +1,362 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+const itemsFile = "items.json"
+
+// Item kinds understood by USE.
+const (
+	ItemBall   = "ball"
+	ItemPotion = "potion"
+	ItemRepel  = "repel"
+	ItemLure   = "lure"
+	ItemStone  = "stone"
+)
+
+type Item struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Kind          string  `json:"kind"`
+	CatchModifier float64 `json:"catchModifier,omitempty"`
+	Heal          int     `json:"heal,omitempty"`
+	Steps         int     `json:"steps,omitempty"`
+	Spawns        int     `json:"spawns,omitempty"`
+	PickupWeight  int     `json:"pickupWeight,omitempty"` // 0 never spawns on the map
+}
+
+type ItemCatalog struct {
+	Items   []Item         `json:"items"`
+	Starter map[string]int `json:"starter"`
+}
+
+// ItemWorld is an item pickup lying on the map.
+type ItemWorld struct {
+	UID      string   `json:"uid"`
+	Item     string   `json:"item"`
+	Quantity int      `json:"quantity"`
+	Position Position `json:"position"`
+}
+
+var (
+	itemCatalog       = map[string]Item{}
+	itemIDs           []string
+	starterItems      = map[string]int{}
+	totalPickupWeight int
+)
+
+var errNotEnoughItems = errors.New("not enough items")
+
+func LoadItemCatalog(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening items file: %v", err)
+	}
+	defer file.Close()
+
+	var catalog ItemCatalog
+	if err := json.NewDecoder(file).Decode(&catalog); err != nil {
+		return fmt.Errorf("error decoding items file: %v", err)
+	}
+
+	itemCatalog = make(map[string]Item, len(catalog.Items))
+	itemIDs = itemIDs[:0]
+	totalPickupWeight = 0
+	for _, item := range catalog.Items {
+		itemCatalog[item.ID] = item
+		itemIDs = append(itemIDs, item.ID)
+		totalPickupWeight += item.PickupWeight
+	}
+	sort.Strings(itemIDs)
+	starterItems = catalog.Starter
+	return nil
+}
+
+func lookupItem(id string) (Item, bool) {
+	item, ok := itemCatalog[id]
+	return item, ok
+}
+
+// randomPickupItem picks an item ID weighted by PickupWeight.
+func randomPickupItem() string {
+	roll := rand.Intn(totalPickupWeight)
+	for _, id := range itemIDs {
+		roll -= itemCatalog[id].PickupWeight
+		if roll < 0 {
+			return id
+		}
+	}
+	return itemIDs[len(itemIDs)-1]
+}
+
+func createRandomItemWorldList(n int) []ItemWorld {
+	if totalPickupWeight == 0 {
+		return []ItemWorld{}
+	}
+	pickups := make([]ItemWorld, n)
+	for i := range pickups {
+		pickups[i] = ItemWorld{
+			UID:      uuid.New().String(),
+			Item:     randomPickupItem(),
+			Quantity: rand.Intn(3) + 1,
+			Position: Position{X: rand.Intn(mapSize), Y: rand.Intn(mapSize)},
+		}
+	}
+	return pickups
+}
+
+// decodeItems converts a user's "items" value into item counts.
+func decodeItems(v interface{}) map[string]int {
+	items := make(map[string]int)
+	switch raw := v.(type) {
+	case map[string]int:
+		for id, n := range raw {
+			items[id] = n
+		}
+	case map[string]interface{}:
+		for id, n := range raw {
+			if f, ok := n.(float64); ok {
+				items[id] = int(f)
+			}
+		}
+	}
+	return items
+}
+
+func newUserItems(user map[string]interface{}) {
+	items := make(map[string]int, len(starterItems))
+	for id, n := range starterItems {
+		items[id] = n
+	}
+	user["items"] = items
+}
+
+func giveItem(user map[string]interface{}, id string, qty int) {
+	items := decodeItems(user["items"])
+	items[id] += qty
+	user["items"] = items
+}
+
+func takeItem(user map[string]interface{}, id string, qty int) error {
+	items := decodeItems(user["items"])
+	if items[id] < qty {
+		return errNotEnoughItems
+	}
+	items[id] -= qty
+	if items[id] == 0 {
+		delete(items, id)
+	}
+	user["items"] = items
+	return nil
+}
+
+// userCounter reads a numeric field such as "repelSteps" from user.
+func userCounter(user map[string]interface{}, key string) int {
+	switch n := user[key].(type) {
+	case int:
+		return n
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// tickItemEffects counts down step-based effects after user moves.
+func tickItemEffects(user map[string]interface{}) {
+	if steps := userCounter(user, "repelSteps"); steps > 0 {
+		user["repelSteps"] = steps - 1
+	}
+}
+
+// SendItems writes the client's inventory to conn.
+func (s *Server) SendItems(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		_, _ = conn.Write([]byte("ITEMS ERROR " + err.Error() + "\n"))
+		return
+	}
+	data, _ := json.Marshal(decodeItems(user["items"]))
+	_, _ = conn.Write([]byte("ITEMS " + string(data) + "\n"))
+}
+
+// CollectItemPickups gives every connected player the pickups lying on
+// their tile.
+func (s *Server) CollectItemPickups() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	pokemonWorldList, err := loadPokemonWorld()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	collected := false
+	for clientID := range s.clients {
+		user := findUser(A, clientID)
+		if user == nil {
+			continue
+		}
+		userPosX := int(user["positionX"].(float64))
+		userPosY := int(user["positionY"].(float64))
+
+		remaining := pokemonWorldList.Items[:0]
+		for _, pickup := range pokemonWorldList.Items {
+			if pickup.Position.X != userPosX || pickup.Position.Y != userPosY {
+				remaining = append(remaining, pickup)
+				continue
+			}
+			giveItem(user, pickup.Item, pickup.Quantity)
+			s.writeToClient(clientID, fmt.Sprintf("ITEM FOUND %s %d", pickup.Item, pickup.Quantity))
+			collected = true
+		}
+		pokemonWorldList.Items = remaining
+	}
+	if !collected {
+		return
+	}
+
+	if err := s.storeClientsData(A); err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	if err := storePokemonWorld(pokemonWorldList); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// UseItem applies item to target for the client. Balls are thrown in the
+// open encounter, potions heal a battling Pokemon, stones evolve target.
+func (s *Server) UseItem(clientID string, conn net.Conn, id, target string) {
+	item, ok := lookupItem(id)
+	if !ok {
+		_, _ = conn.Write([]byte("UNKNOWN ITEM " + id + "\n"))
+		return
+	}
+	if item.Kind == ItemBall {
+		s.ThrowBall(clientID, conn, id)
+		return
+	}
+
+	events, err := s.useItem(clientID, item, target)
+	if err != nil {
+		_, _ = conn.Write([]byte("USE ERROR " + err.Error() + "\n"))
+		return
+	}
+	for _, event := range events {
+		_, _ = conn.Write([]byte(event + "\n"))
+	}
+}
+
+func (s *Server) useItem(clientID string, item Item, target string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		return nil, err
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return nil, errors.New("unknown player")
+	}
+	if decodeItems(user["items"])[item.ID] < 1 {
+		return nil, errNotEnoughItems
+	}
+
+	var events []string
+	switch item.Kind {
+	case ItemPotion:
+		battle, inBattle := s.battles[clientID]
+		if !inBattle {
+			return nil, errors.New("potions can only be used in battle")
+		}
+		events, err = battle.Heal(target, item.Heal)
+	case ItemRepel:
+		user["repelSteps"] = userCounter(user, "repelSteps") + item.Steps
+		events = []string{fmt.Sprintf("REPEL ACTIVE %d", userCounter(user, "repelSteps"))}
+	case ItemLure:
+		events, err = lureWildPokemon(user, item.Spawns)
+	case ItemStone:
+		events, err = s.useStone(user, item.ID, target)
+	default:
+		err = errors.New("item cannot be used")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := takeItem(user, item.ID, 1); err != nil {
+		return nil, err
+	}
+	if battle, inBattle := s.battles[clientID]; inBattle && battle.Result != BattleOngoing {
+		s.finishBattle(clientID, battle)
+	}
+	return events, s.storeClientsData(A)
+}
+
+// lureWildPokemon spawns n wild Pokemon next to user.
+func lureWildPokemon(user map[string]interface{}, n int) ([]string, error) {
+	pokemonWorldList, err := loadPokemonWorld()
+	if err != nil {
+		return nil, err
+	}
+	userPos := userPosition(user)
+
+	events := []string{}
+	for i := 0; i < n; i++ {
+		position := clampToMap(Position{
+			X: userPos.X + rand.Intn(5) - 2,
+			Y: userPos.Y + rand.Intn(5) - 2,
+		})
+		home := position
+		pokemonWorld := PokemonWorld{
+			Pokemon:  createWildPokemon(position),
+			Position: position,
+			Home:     &home,
+		}
+		pokemonWorldList.PokemonWorlds = append(pokemonWorldList.PokemonWorlds, pokemonWorld)
+		data, _ := json.Marshal(pokemonWorld)
+		events = append(events, "LURED "+string(data))
+	}
+	return events, storePokemonWorld(pokemonWorldList)
+}
+
+// useStone evolves the party member uid if its species evolves with stone.
+// Caller must hold s.mutex.
+func (s *Server) useStone(user map[string]interface{}, stone, uid string) ([]string, error) {
+	party := decodeListPokemon(user["listPokemon"])
+	for i := range party {
+		if party[i].UID != uid {
+			continue
+		}
+		sp, _ := lookupSpecies(party[i].ID)
+		for _, evo := range sp.EvolvesTo {
+			if evo.Item == stone {
+				event := evolve(&party[i], evo.ID)
+				setStorage(user, party, decodeBoxes(user["boxes"]))
+				s.registerCaught(user, evo.ID)
+				return []string{event}, nil
+			}
+		}
+		return nil, errors.New("no effect")
+	}
+	return nil, errors.New("Pokemon not in party")
+}
@@ -0,0 +1,26 @@
+package PubSub
+
+import "testing"
+
+func TestLureStaysOnMap(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	chdirTemp(t)
+	for _, corner := range []Position{{X: 0, Y: 0}, {X: mapSize - 1, Y: mapSize - 1}, {X: 0, Y: mapSize - 1}} {
+		if err := storePokemonWorld(PokemonWorldList{}); err != nil {
+			t.Fatal(err)
+		}
+		user := map[string]interface{}{"positionX": float64(corner.X), "positionY": float64(corner.Y)}
+		if _, err := lureWildPokemon(user, 20); err != nil {
+			t.Fatal(err)
+		}
+		list, err := loadPokemonWorld()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pw := range list.PokemonWorlds {
+			if !onMap(pw.Position) || pw.Home == nil || *pw.Home != pw.Position {
+				t.Errorf("lured at %v: position %v, home %v", corner, pw.Position, pw.Home)
+			}
+		}
+	}
+}
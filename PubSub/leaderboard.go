@@ -0,0 +1,192 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	leaderboardFile    = "leaderboard.json"
+	leaderboardChannel = "leaderboard"
+	leaderboardTopSize = 10
+)
+
+// Board names accepted by TOP.
+const (
+	BoardCaught  = "caught"
+	BoardLevel   = "level"
+	BoardPokedex = "pokedex"
+	BoardWins    = "wins"
+)
+
+var boardNames = []string{BoardCaught, BoardLevel, BoardPokedex, BoardWins}
+
+type LeaderboardEntry struct {
+	Player string `json:"player"`
+	Score  int    `json:"score"`
+}
+
+// Leaderboards keeps a score per player for every board. Scores are pushed
+// in as game state changes, so ranking never rescans clients.json. It has
+// its own lock and may be used with or without s.mutex held.
+type Leaderboards struct {
+	mutex  sync.Mutex
+	scores map[string]map[string]int
+}
+
+func NewLeaderboards() *Leaderboards {
+	l := &Leaderboards{scores: make(map[string]map[string]int)}
+	for _, board := range boardNames {
+		l.scores[board] = make(map[string]int)
+	}
+	return l
+}
+
+func (l *Leaderboards) Add(board, player string, delta int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.scores[board][player] += delta
+}
+
+func (l *Leaderboards) Set(board, player string, score int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.scores[board][player] = score
+}
+
+// Max raises player's score on board to score if it is higher.
+func (l *Leaderboards) Max(board, player string, score int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if score > l.scores[board][player] {
+		l.scores[board][player] = score
+	}
+}
+
+// Top returns the n best entries of board, highest first.
+func (l *Leaderboards) Top(board string, n int) ([]LeaderboardEntry, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	scores, ok := l.scores[board]
+	if !ok {
+		return nil, false
+	}
+	entries := make([]LeaderboardEntry, 0, len(scores))
+	for player, score := range scores {
+		entries = append(entries, LeaderboardEntry{Player: player, Score: score})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].Player < entries[j].Player
+	})
+	if n < len(entries) {
+		entries = entries[:n]
+	}
+	return entries, true
+}
+
+func (l *Leaderboards) Save(fileName string) error {
+	l.mutex.Lock()
+	data, err := json.Marshal(l.scores)
+	l.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding leaderboards: %v", err)
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
+
+func (l *Leaderboards) Load(fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading leaderboards: %v", err)
+	}
+
+	var scores map[string]map[string]int
+	if err := json.Unmarshal(data, &scores); err != nil {
+		return fmt.Errorf("error decoding leaderboards: %v", err)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for board, players := range scores {
+		if _, known := l.scores[board]; known {
+			l.scores[board] = players
+		}
+	}
+	return nil
+}
+
+// recordGameEvent updates the boards an event counts towards.
+func (l *Leaderboards) recordGameEvent(player string, event GameEvent) {
+	switch event.Type {
+	case EventCapture:
+		l.Add(BoardCaught, player, 1)
+	case EventBattleWon:
+		l.Add(BoardWins, player, 1)
+	}
+}
+
+// startLeaderboardBroadcast publishes every board on the leaderboard
+// channel and saves a snapshot on each tick.
+func (s *Server) startLeaderboardBroadcast() {
+	for s.tick(s.leaderboardTicker) {
+		for _, board := range boardNames {
+			entries, _ := s.leaderboards.Top(board, leaderboardTopSize)
+			data, _ := json.Marshal(entries)
+			s.PublishMessage(leaderboardChannel, "LEADERBOARD "+board+" "+string(data))
+		}
+		if err := s.leaderboards.Save(leaderboardFile); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	}
+}
+
+// SendTop writes the n best entries of board to conn.
+func (s *Server) SendTop(conn net.Conn, board, nText string) {
+	entries, err := s.top(board, nText)
+	if err != nil {
+		_, _ = conn.Write([]byte("TOP ERROR " + err.Error() + "\n"))
+		return
+	}
+	data, _ := json.Marshal(entries)
+	_, _ = conn.Write([]byte("TOP " + board + " " + string(data) + "\n"))
+}
+
+// ShowTopInConsole prints the n best entries of board.
+func (s *Server) ShowTopInConsole(board, nText string) {
+	entries, err := s.top(board, nText)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Top %s:\n", board)
+	for i, entry := range entries {
+		fmt.Printf("%d. %s %d\n", i+1, entry.Player, entry.Score)
+	}
+}
+
+func (s *Server) top(board, nText string) ([]LeaderboardEntry, error) {
+	n := leaderboardTopSize
+	if nText != "" {
+		var err error
+		n, err = strconv.Atoi(nText)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid count %s", nText)
+		}
+	}
+	entries, ok := s.leaderboards.Top(board, n)
+	if !ok {
+		return nil, fmt.Errorf("unknown board %s", board)
+	}
+	return entries, nil
+}
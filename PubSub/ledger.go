@@ -0,0 +1,293 @@
+package PubSub
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ledgerFile = "ledger.jsonl"
+
+	// pendingLedgerKey holds a user's ledger entries until their clients.json
+	// entry is stored.
+	pendingLedgerKey = "pendingLedger"
+)
+
+// Currency rewards and the balance new players start with.
+const (
+	starterBalance   = 500
+	captureReward    = 50
+	battleRewardPerL = 20 // per level of the defeated wild Pokemon
+	pvpReward        = 200
+
+	raidParticipationReward = 100  // every raid participant who attacked
+	raidRewardPool          = 1000 // split among raid participants by damage
+)
+
+var errInsufficientFunds = errors.New("insufficient funds")
+
+// LedgerEntry is one credit (positive Amount) or debit (negative Amount).
+// The ledger is append-only: a rollback is a new entry that Reverses an
+// earlier one.
+type LedgerEntry struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"clientID"`
+	Amount   int       `json:"amount"`
+	Balance  int       `json:"balance"`
+	Reason   string    `json:"reason"`
+	Reverses string    `json:"reverses,omitempty"`
+}
+
+func appendLedger(entry LedgerEntry) error {
+	file, err := os.OpenFile(ledgerFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening ledger file: %v", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(entry); err != nil {
+		return fmt.Errorf("error writing ledger entry: %v", err)
+	}
+	return nil
+}
+
+func readLedger() ([]LedgerEntry, error) {
+	file, err := os.Open(ledgerFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening ledger file: %v", err)
+	}
+	defer file.Close()
+
+	var entries []LedgerEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("error decoding ledger entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// ledgerBalance returns the sum of clientID's ledger entries and whether
+// they have any.
+func ledgerBalance(clientID string) (int, bool, error) {
+	entries, err := readLedger()
+	if err != nil {
+		return 0, false, err
+	}
+	sum, found := 0, false
+	for _, entry := range entries {
+		if entry.ClientID == clientID {
+			sum += entry.Amount
+			found = true
+		}
+	}
+	return sum, found, nil
+}
+
+// newLedgerEntry returns the entry that credits or debits user by amount,
+// or errInsufficientFunds if it would overdraw.
+func newLedgerEntry(user map[string]interface{}, amount int, reason string) (LedgerEntry, error) {
+	balance := userCounter(user, "balance") + amount
+	if balance < 0 {
+		return LedgerEntry{}, errInsufficientFunds
+	}
+	clientID, _ := user["uID"].(string)
+	return LedgerEntry{
+		ID:       uuid.New().String(),
+		Time:     time.Now(),
+		ClientID: clientID,
+		Amount:   amount,
+		Balance:  balance,
+		Reason:   reason,
+	}, nil
+}
+
+// applyLedgerEntry sets user's balance and queues entry for the ledger.
+// storeClientsData writes it once the new balance is stored, so a failed
+// or abandoned store leaves no entry behind.
+func applyLedgerEntry(user map[string]interface{}, entry LedgerEntry) {
+	pending, _ := user[pendingLedgerKey].([]LedgerEntry)
+	user[pendingLedgerKey] = append(pending, entry)
+	user["balance"] = entry.Balance
+}
+
+// takePendingLedger removes the queued ledger entries from every user of
+// A and returns them.
+func takePendingLedger(A map[string]interface{}) []LedgerEntry {
+	var entries []LedgerEntry
+	users, _ := A["user"].([]interface{})
+	for _, u := range users {
+		user, ok := u.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		pending, _ := user[pendingLedgerKey].([]LedgerEntry)
+		entries = append(entries, pending...)
+		delete(user, pendingLedgerKey)
+	}
+	return entries
+}
+
+// adjustBalance credits or debits user. A debit that would overdraw fails
+// without touching anything. Caller must hold s.mutex and persist user
+// with storeClientsData, which records the change in the ledger.
+func adjustBalance(user map[string]interface{}, amount int, reason string) (LedgerEntry, error) {
+	entry, err := newLedgerEntry(user, amount, reason)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	applyLedgerEntry(user, entry)
+	return entry, nil
+}
+
+// reward credits user and tells the client. Caller must hold s.mutex and
+// persist user.
+func (s *Server) reward(user map[string]interface{}, amount int, reason string) {
+	entry, err := adjustBalance(user, amount, reason)
+	if err != nil {
+		fmt.Printf("Error crediting reward: %v\n", err)
+		return
+	}
+	s.writeToClient(entry.ClientID, fmt.Sprintf("CREDIT %d %s %d", amount, reason, entry.Balance))
+}
+
+// SendBalance writes the client's balance to conn.
+func (s *Server) SendBalance(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		_, _ = conn.Write([]byte("BALANCE ERROR " + err.Error() + "\n"))
+		return
+	}
+	_, _ = conn.Write([]byte(fmt.Sprintf("BALANCE %d\n", userCounter(user, "balance"))))
+}
+
+// AuditLedger prints clientID's ledger entries and checks that they add up
+// to the stored balance.
+func (s *Server) AuditLedger(clientID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := readLedger()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	sum := 0
+	for _, entry := range entries {
+		if entry.ClientID != clientID {
+			continue
+		}
+		sum += entry.Amount
+		fmt.Printf("%s %s %+d = %d %s %s\n", entry.Time.Format(time.RFC3339), entry.ID, entry.Amount, entry.Balance, entry.Reason, entry.Reverses)
+	}
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		list, err := s.loadAccounts()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+		account := list.find(func(a *Account) bool { return a.PlayerID == clientID })
+		if account == nil || account.Player == nil {
+			fmt.Printf("Ledger total %d (no saved player)\n", sum)
+			return
+		}
+		user = account.Player
+	}
+	balance := userCounter(user, "balance")
+	if balance != sum {
+		fmt.Printf("MISMATCH ledger total %d, stored balance %d\n", sum, balance)
+		return
+	}
+	fmt.Printf("Ledger total %d matches balance\n", sum)
+}
+
+// RollbackLedgerEntry reverses entryID with a compensating entry. An
+// offline player's balance is corrected in their account. A rollback that
+// would leave the balance below zero is refused.
+func (s *Server) RollbackLedgerEntry(entryID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := readLedger()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	var target *LedgerEntry
+	for i := range entries {
+		if entries[i].Reverses == entryID {
+			fmt.Printf("Entry %s already rolled back by %s\n", entryID, entries[i].ID)
+			return
+		}
+		if entries[i].ID == entryID {
+			target = &entries[i]
+		}
+	}
+	if target == nil {
+		fmt.Printf("Ledger entry %s not found\n", entryID)
+		return
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	user := findUser(A, target.ClientID)
+	var list *AccountList
+	var account *Account
+	if user == nil {
+		if list, err = s.loadAccounts(); err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+		account = list.find(func(a *Account) bool { return a.PlayerID == target.ClientID })
+		if account == nil || account.Player == nil {
+			fmt.Printf("Player %s not found\n", target.ClientID)
+			return
+		}
+		user = account.Player
+	}
+
+	entry, err := newLedgerEntry(user, -target.Amount, "rollback")
+	if err != nil {
+		fmt.Printf("Cannot roll back %s: %v\n", entryID, err)
+		return
+	}
+	entry.ClientID = target.ClientID
+	entry.Reverses = target.ID
+	if account == nil {
+		applyLedgerEntry(user, entry)
+		err = s.storeClientsData(A)
+	} else {
+		user["balance"] = entry.Balance
+		if err = s.storeAccounts(list); err == nil {
+			err = appendLedger(entry)
+		}
+	}
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	s.writeToClient(target.ClientID, fmt.Sprintf("BALANCE %d", entry.Balance))
+	fmt.Printf("Rolled back %s, new balance %d\n", entryID, entry.Balance)
+}
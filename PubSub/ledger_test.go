@@ -0,0 +1,200 @@
+package PubSub
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// useShops replaces the shop list for the length of the test.
+func useShops(t *testing.T, list ...Shop) {
+	t.Helper()
+	saved := shops
+	shops = list
+	t.Cleanup(func() { shops = saved })
+}
+
+// credit adds amount to clientID's balance the way rewards do.
+func credit(t *testing.T, s *Server, clientID string, amount int) LedgerEntry {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	A, err := s.loadClientsData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := adjustBalance(findUser(A, clientID), amount, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.storeClientsData(A); err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func balanceOf(t *testing.T, s *Server, clientID string) int {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userCounter(user, "balance")
+}
+
+// ledgerTotal sums clientID's ledger entries.
+func ledgerTotal(t *testing.T, clientID string) (int, []LedgerEntry) {
+	t.Helper()
+	entries, err := readLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := 0
+	var own []LedgerEntry
+	for _, entry := range entries {
+		if entry.ClientID == clientID {
+			sum += entry.Amount
+			own = append(own, entry)
+		}
+	}
+	return sum, own
+}
+
+func newShopTest(t *testing.T) *Server {
+	t.Helper()
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	useShops(t, Shop{ID: "mart", Position: Position{X: 5, Y: 5}, Stock: []ShopItem{{Item: "pokeball", Price: 200}}})
+	s := newTestServer(t)
+	addTestPlayer(t, s, "ash", Position{X: 5, Y: 6}, testParty())
+	credit(t, s, "ash", 500)
+	return s
+}
+
+func TestBuy(t *testing.T) {
+	s := newShopTest(t)
+
+	tests := []struct {
+		item, qty string
+		wantErr   bool
+	}{
+		{"pokeball", "0", true},
+		{"pokeball", "100", true},
+		{"pokeball", "x", true},
+		{"potion", "1", true},
+		{"pokeball", "3", true}, // 600 > 500
+		{"pokeball", "99", true},
+		{"pokeball", "2", false},
+	}
+	for _, tt := range tests {
+		s.mutex.Lock()
+		balance, err := s.buy("ash", tt.item, tt.qty)
+		s.mutex.Unlock()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("buy %s x%s: balance %d, error %v", tt.item, tt.qty, balance, err)
+		}
+	}
+
+	if got := balanceOf(t, s, "ash"); got != 100 {
+		t.Errorf("balance = %d, want 100", got)
+	}
+	sum, entries := ledgerTotal(t, "ash")
+	if sum != 100 || len(entries) != 2 || entries[1].Amount != -400 {
+		t.Errorf("ledger total %d, entries %+v", sum, entries)
+	}
+}
+
+func TestLedgerWrittenOnlyWhenStored(t *testing.T) {
+	s := newShopTest(t)
+
+	s.mutex.Lock()
+	A, err := s.loadClientsData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adjustBalance(findUser(A, "ash"), 1000, "lost"); err != nil {
+		t.Fatal(err)
+	}
+	saved := s.jsonFile
+	s.jsonFile = filepath.Join("missing", "clients.json")
+	err = s.storeClientsData(A)
+	s.jsonFile = saved
+	s.mutex.Unlock()
+	if err == nil {
+		t.Fatal("store into a missing directory succeeded")
+	}
+
+	if sum, entries := ledgerTotal(t, "ash"); sum != 500 || len(entries) != 1 {
+		t.Errorf("ledger after a failed store: total %d, entries %+v", sum, entries)
+	}
+	if got := balanceOf(t, s, "ash"); got != 500 {
+		t.Errorf("balance = %d, want 500", got)
+	}
+}
+
+func TestRollbackLedgerEntry(t *testing.T) {
+	s := newShopTest(t)
+	s.mutex.Lock()
+	if _, err := s.buy("ash", "pokeball", "2"); err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Unlock()
+	_, entries := ledgerTotal(t, "ash")
+	deposit, purchase := entries[0], entries[1]
+
+	// Taking back the 500 would leave -400.
+	s.RollbackLedgerEntry(deposit.ID)
+	if got := balanceOf(t, s, "ash"); got != 100 {
+		t.Errorf("balance after a refused rollback = %d, want 100", got)
+	}
+
+	s.RollbackLedgerEntry(purchase.ID)
+	s.RollbackLedgerEntry(purchase.ID)
+	if got := balanceOf(t, s, "ash"); got != 500 {
+		t.Errorf("balance after the rollback = %d, want 500", got)
+	}
+	sum, entries := ledgerTotal(t, "ash")
+	if sum != 500 || len(entries) != 3 || entries[2].Reverses != purchase.ID {
+		t.Errorf("ledger total %d, entries %+v", sum, entries)
+	}
+}
+
+func TestRollbackOfflinePlayer(t *testing.T) {
+	s := newShopTest(t)
+	entry := credit(t, s, "ash", 300)
+
+	s.mutex.Lock()
+	user, err := s.loadUser("ash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &AccountList{Accounts: []*Account{{Username: "ash", PlayerID: "ash", Player: user}}}
+	if err := s.storeAccounts(list); err != nil {
+		t.Fatal(err)
+	}
+	A, _ := s.loadClientsData()
+	A["user"] = []interface{}{}
+	if err := s.storeClientsData(A); err != nil {
+		t.Fatal(err)
+	}
+	delete(s.clients, "ash")
+	s.mutex.Unlock()
+
+	s.RollbackLedgerEntry(entry.ID)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list, err = s.loadAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := userCounter(list.Accounts[0].Player, "balance"); got != 500 {
+		t.Errorf("saved balance = %d, want 500", got)
+	}
+	if sum, _ := ledgerTotal(t, "ash"); sum != 500 {
+		t.Errorf("ledger total = %d, want 500", sum)
+	}
+	if _, err := s.loadUser("ash"); err == nil {
+		t.Error("rollback brought the offline player back into clients.json")
+	}
+}
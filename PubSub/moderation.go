@@ -0,0 +1,509 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	moderationFile = "moderation.json"
+	wordFilterFile = "wordfilter.json"
+)
+
+// Ban kinds.
+const (
+	BanAccount = "account"
+	BanIP      = "ip"
+)
+
+// muteAllChannels mutes a player on every channel.
+const muteAllChannels = "*"
+
+var errMuted = errors.New("muted on this channel")
+
+// Ban keeps an account or an IP address off the server until Until, or
+// for good when Until is zero.
+type Ban struct {
+	Kind    string    `json:"kind"`
+	Target  string    `json:"target"` // playerID or IP address
+	Name    string    `json:"name,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Until   time.Time `json:"until"`
+}
+
+func (b Ban) active(now time.Time) bool {
+	return b.Until.IsZero() || now.Before(b.Until)
+}
+
+func (b Ban) describe() string {
+	if b.Until.IsZero() {
+		return "permanently"
+	}
+	return "until " + b.Until.Format(time.RFC3339)
+}
+
+// ChannelMute stops a player publishing on Channel until Until, or for
+// good when Until is zero.
+type ChannelMute struct {
+	ClientID string    `json:"clientID"`
+	Channel  string    `json:"channel"`
+	Until    time.Time `json:"until"`
+}
+
+// Moderation holds bans, channel mutes and the chat word filter. It has
+// its own lock so a new connection can be checked without s.mutex.
+type Moderation struct {
+	mutex  sync.Mutex
+	bans   []Ban
+	mutes  []ChannelMute
+	words  []string
+	filter *regexp.Regexp
+}
+
+func NewModeration() *Moderation {
+	return &Moderation{}
+}
+
+type moderationState struct {
+	Bans  []Ban         `json:"bans"`
+	Mutes []ChannelMute `json:"mutes"`
+}
+
+func (m *Moderation) Save(fileName string) error {
+	m.mutex.Lock()
+	data, err := json.Marshal(moderationState{Bans: m.bans, Mutes: m.mutes})
+	m.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding moderation file: %v", err)
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
+
+func (m *Moderation) Load(fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading moderation file: %v", err)
+	}
+	var state moderationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("error decoding moderation file: %v", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.bans, m.mutes = state.Bans, state.Mutes
+	return nil
+}
+
+// SaveWords writes the word filter to fileName.
+func (m *Moderation) SaveWords(fileName string) error {
+	m.mutex.Lock()
+	data, err := json.MarshalIndent(struct {
+		Words []string `json:"words"`
+	}{m.words}, "", "  ")
+	m.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding word filter: %v", err)
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// LoadWords reads the word filter from fileName.
+func (m *Moderation) LoadWords(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening word filter file: %v", err)
+	}
+	defer file.Close()
+
+	var list struct {
+		Words []string `json:"words"`
+	}
+	if err := json.NewDecoder(file).Decode(&list); err != nil {
+		return fmt.Errorf("error decoding word filter file: %v", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.setWords(list.Words)
+	return nil
+}
+
+// setWords replaces the filtered words and rebuilds the filter. Caller
+// must hold m.mutex.
+func (m *Moderation) setWords(words []string) {
+	quoted := make([]string, 0, len(words))
+	m.words = m.words[:0]
+	for _, word := range words {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word == "" {
+			continue
+		}
+		m.words = append(m.words, word)
+		quoted = append(quoted, regexp.QuoteMeta(word))
+	}
+	sort.Strings(m.words)
+	m.filter = nil
+	if len(quoted) > 0 {
+		m.filter = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	}
+}
+
+// AddWord adds word to the filter, or removes it when remove is set.
+func (m *Moderation) AddWord(word string, remove bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	word = strings.ToLower(word)
+	words := make([]string, 0, len(m.words)+1)
+	for _, w := range m.words {
+		if w != word {
+			words = append(words, w)
+		}
+	}
+	if !remove {
+		words = append(words, word)
+	}
+	m.setWords(words)
+}
+
+func (m *Moderation) Words() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.words...)
+}
+
+// Filter masks every filtered word in message with asterisks.
+func (m *Moderation) Filter(message string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.filter == nil {
+		return message
+	}
+	return m.filter.ReplaceAllStringFunc(message, func(word string) string {
+		return strings.Repeat("*", len(word))
+	})
+}
+
+// AddBan bans ban.Target, replacing an earlier ban of the same target.
+func (m *Moderation) AddBan(ban Ban) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeBan(ban.Target)
+	m.bans = append(m.bans, ban)
+}
+
+// RemoveBan lifts the ban on target, a playerID, username or IP address.
+func (m *Moderation) RemoveBan(target string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.removeBan(target)
+}
+
+func (m *Moderation) removeBan(target string) bool {
+	kept := m.bans[:0]
+	for _, ban := range m.bans {
+		if ban.Target != target && !strings.EqualFold(ban.Name, target) {
+			kept = append(kept, ban)
+		}
+	}
+	removed := len(kept) < len(m.bans)
+	m.bans = kept
+	return removed
+}
+
+// Banned returns the active ban of kind on target, if there is one.
+func (m *Moderation) Banned(kind, target string) (Ban, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for _, ban := range m.bans {
+		if ban.Kind == kind && ban.Target == target && ban.active(now) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// Bans returns the active bans.
+func (m *Moderation) Bans() []Ban {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	var active []Ban
+	for _, ban := range m.bans {
+		if ban.active(now) {
+			active = append(active, ban)
+		}
+	}
+	return active
+}
+
+// Mute stops clientID publishing on channel, or on every channel for
+// muteAllChannels, until until.
+func (m *Moderation) Mute(clientID, channel string, until time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.unmute(clientID, channel)
+	m.mutes = append(m.mutes, ChannelMute{ClientID: clientID, Channel: channel, Until: until})
+}
+
+func (m *Moderation) Unmute(clientID, channel string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.unmute(clientID, channel)
+}
+
+func (m *Moderation) unmute(clientID, channel string) bool {
+	kept := m.mutes[:0]
+	for _, mute := range m.mutes {
+		if mute.ClientID != clientID || mute.Channel != channel {
+			kept = append(kept, mute)
+		}
+	}
+	removed := len(kept) < len(m.mutes)
+	m.mutes = kept
+	return removed
+}
+
+// Muted reports whether clientID may not publish on channel.
+func (m *Moderation) Muted(clientID, channel string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for _, mute := range m.mutes {
+		if mute.ClientID == clientID && (mute.Channel == channel || mute.Channel == muteAllChannels) &&
+			(mute.Until.IsZero() || now.Before(mute.Until)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBanDuration reads a duration such as 30m, 12h or 7d. "permanent"
+// and 0 mean no end.
+func parseBanDuration(text string) (time.Duration, error) {
+	if text == "permanent" || text == "0" {
+		return 0, nil
+	}
+	if days, found := strings.CutSuffix(text, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %s", text)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %s", text)
+	}
+	return d, nil
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// RefuseBanned closes conn if its address is banned. It is called on
+// Accept, before the connection is handled.
+func (s *Server) RefuseBanned(conn net.Conn) bool {
+	ip := remoteIP(conn)
+	if _, banned := s.moderation.Banned(BanIP, ip); !banned {
+		return false
+	}
+	fmt.Printf("Refused connection from banned address %s\n", ip)
+	conn.Close()
+	return true
+}
+
+// resolvePlayer returns the playerID and username of the account named
+// by name, which may be either.
+func (s *Server) resolvePlayer(name string) (string, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list, err := s.loadAccounts()
+	if err != nil {
+		return "", "", err
+	}
+	account := list.find(func(a *Account) bool { return a.PlayerID == name || strings.EqualFold(a.Username, name) })
+	if account == nil {
+		return "", "", fmt.Errorf("unknown player %s", name)
+	}
+	return account.PlayerID, account.Username, nil
+}
+
+// kick closes the connection of every online player matched by match.
+// Caller must hold s.mutex.
+func (s *Server) kick(reason string, match func(clientID string, conn net.Conn) bool) int {
+	kicked := 0
+	for clientID, conn := range s.clients {
+		if !match(clientID, conn) {
+			continue
+		}
+		s.writeToClient(clientID, "KICKED "+reason)
+		conn.Close()
+		kicked++
+	}
+	return kicked
+}
+
+// ModerationCommandInConsole runs KICK, BAN, UNBAN, BANS, MUTE, UNMUTE and
+// FILTER from the console.
+func (s *Server) ModerationCommandInConsole(command string, args []string) {
+	var err error
+	switch command {
+	case "KICK":
+		err = s.kickInConsole(args)
+	case "BAN":
+		err = s.banInConsole(args)
+	case "UNBAN":
+		if len(args) < 1 {
+			fmt.Println("Usage: UNBAN <account|ip>")
+			return
+		}
+		if !s.moderation.RemoveBan(args[0]) {
+			err = fmt.Errorf("%s is not banned", args[0])
+		}
+	case "BANS":
+		for _, ban := range s.moderation.Bans() {
+			fmt.Printf("%s %s %s %s %s\n", ban.Kind, ban.Target, ban.Name, ban.describe(), ban.Reason)
+		}
+		return
+	case "MUTE", "UNMUTE":
+		err = s.muteInConsole(command, args)
+	case "FILTER":
+		err = s.filterInConsole(args)
+		if err != nil || args[0] == "LIST" {
+			if err != nil {
+				fmt.Println(err)
+			}
+			return
+		}
+		if err := s.moderation.SaveWords(wordFilterFile); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%s done\n", command)
+		return
+	}
+	if err == nil {
+		err = s.moderation.Save(moderationFile)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("%s done\n", command)
+}
+
+func (s *Server) kickInConsole(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: KICK <player> [reason]")
+	}
+	playerID, _, err := s.resolvePlayer(args[0])
+	if err != nil {
+		playerID = args[0]
+	}
+	reason := strings.Join(args[1:], " ")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.kick(reason, func(clientID string, conn net.Conn) bool { return clientID == playerID }) == 0 {
+		return fmt.Errorf("%s is not online", args[0])
+	}
+	return nil
+}
+
+func (s *Server) banInConsole(args []string) error {
+	if len(args) < 2 {
+		return errors.New("Usage: BAN <account|ip> <duration|permanent> [reason]")
+	}
+	duration, err := parseBanDuration(args[1])
+	if err != nil {
+		return err
+	}
+	ban := Ban{Kind: BanIP, Target: args[0], Reason: strings.Join(args[2:], " "), Created: time.Now()}
+	if duration > 0 {
+		ban.Until = ban.Created.Add(duration)
+	}
+	if net.ParseIP(args[0]) == nil {
+		ban.Kind = BanAccount
+		if ban.Target, ban.Name, err = s.resolvePlayer(args[0]); err != nil {
+			return err
+		}
+	}
+	s.moderation.AddBan(ban)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.kick("banned "+ban.describe(), func(clientID string, conn net.Conn) bool {
+		if ban.Kind == BanIP {
+			return remoteIP(conn) == ban.Target
+		}
+		return clientID == ban.Target
+	})
+	return nil
+}
+
+func (s *Server) muteInConsole(command string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Usage: %s <player> <channel|*> [duration]", command)
+	}
+	playerID, _, err := s.resolvePlayer(args[0])
+	if err != nil {
+		return err
+	}
+	channel := args[1]
+	if command == "UNMUTE" {
+		if !s.moderation.Unmute(playerID, channel) {
+			return fmt.Errorf("%s is not muted on %s", args[0], channel)
+		}
+		return nil
+	}
+
+	var until time.Time
+	if len(args) > 2 {
+		duration, err := parseBanDuration(args[2])
+		if err != nil {
+			return err
+		}
+		if duration > 0 {
+			until = time.Now().Add(duration)
+		}
+	}
+	s.moderation.Mute(playerID, channel, until)
+	s.mutex.Lock()
+	s.writeToClient(playerID, "MUTED ON "+channel)
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *Server) filterInConsole(args []string) error {
+	if len(args) < 1 || (args[0] != "LIST" && len(args) < 2) {
+		return errors.New("Usage: FILTER ADD|REMOVE <word>|LIST")
+	}
+	switch args[0] {
+	case "LIST":
+		fmt.Println(strings.Join(s.moderation.Words(), " "))
+	case "ADD":
+		s.moderation.AddWord(args[1], false)
+	case "REMOVE":
+		s.moderation.AddWord(args[1], true)
+	default:
+		return errors.New("Usage: FILTER ADD|REMOVE <word>|LIST")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package PubSub
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBanDuration(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"permanent", 0, false},
+		{"0", 0, false},
+		{"30m", 30 * time.Minute, false},
+		{"12h", 12 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"0d", 0, false},
+		{"-1d", 0, true},
+		{"-5m", 0, true},
+		{"xd", 0, true},
+		{"1.5d", 0, true},
+		{"d", 0, true},
+		{"forever", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseBanDuration(tt.text)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseBanDuration(%q) = %v, %v; want %v, error %v", tt.text, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestWordFilter(t *testing.T) {
+	m := NewModeration()
+	if got := m.Filter("no words yet"); got != "no words yet" {
+		t.Errorf("empty filter changed the message to %q", got)
+	}
+
+	file := filepath.Join(t.TempDir(), wordFilterFile)
+	if err := os.WriteFile(file, []byte(`{"words": ["darn", " HECK ", "", "a.b"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadWords(file); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Words(), []string{"a.b", "darn", "heck"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("words = %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"darn it", "**** it"},
+		{"DARN it", "**** it"},
+		{"what the heck, darn!", "what the ****, ****!"},
+		{"darning socks", "darning socks"},
+		{"undarn", "undarn"},
+		{"a.b and axb", "*** and axb"},
+		{"nothing to hide", "nothing to hide"},
+	}
+	for _, tt := range tests {
+		if got := m.Filter(tt.message); got != tt.want {
+			t.Errorf("Filter(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+
+	m.AddWord("Gosh", false)
+	m.AddWord("darn", true)
+	if got, want := m.Filter("gosh darn"), "**** darn"; got != want {
+		t.Errorf("after AddWord: Filter = %q, want %q", got, want)
+	}
+	if got, want := m.Words(), []string{"a.b", "gosh", "heck"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after AddWord: words = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	viewRadius          = 5 // tiles around a player in which wild Pokemon are seen
+	achievementsChannel = "achievements"
+)
+
+// pokedexMilestones are the caught percentages announced as achievements.
+var pokedexMilestones = []int{10, 25, 50, 75, 100}
+
+// PokedexEntry records when a player first saw and first caught a species.
+type PokedexEntry struct {
+	Seen   time.Time  `json:"seen"`
+	Caught *time.Time `json:"caught,omitempty"`
+}
+
+type PokedexSummary struct {
+	Seen      int                     `json:"seen"`
+	Caught    int                     `json:"caught"`
+	Total     int                     `json:"total"`
+	SeenPct   float64                 `json:"seenPct"`
+	CaughtPct float64                 `json:"caughtPct"`
+	Entries   map[string]PokedexEntry `json:"entries"`
+}
+
+// decodePokedex converts a user's "pokedex" value, keyed by species ID.
+func decodePokedex(v interface{}) map[string]PokedexEntry {
+	pokedex := make(map[string]PokedexEntry)
+	if existing, ok := v.(map[string]PokedexEntry); ok {
+		for id, entry := range existing {
+			pokedex[id] = entry
+		}
+		return pokedex
+	}
+	if v == nil {
+		return pokedex
+	}
+	if data, err := json.Marshal(v); err == nil {
+		_ = json.Unmarshal(data, &pokedex)
+	}
+	return pokedex
+}
+
+func summarizePokedex(pokedex map[string]PokedexEntry) PokedexSummary {
+	summary := PokedexSummary{Total: len(speciesCatalog), Entries: pokedex}
+	for _, entry := range pokedex {
+		summary.Seen++
+		if entry.Caught != nil {
+			summary.Caught++
+		}
+	}
+	if summary.Total > 0 {
+		summary.SeenPct = float64(summary.Seen) * 100 / float64(summary.Total)
+		summary.CaughtPct = float64(summary.Caught) * 100 / float64(summary.Total)
+	}
+	return summary
+}
+
+// registerSeen marks species id as seen by user. It reports whether the
+// entry is new. Caller must hold s.mutex and persist user.
+func registerSeen(user map[string]interface{}, id int) bool {
+	pokedex := decodePokedex(user["pokedex"])
+	key := strconv.Itoa(id)
+	if _, seen := pokedex[key]; seen {
+		return false
+	}
+	pokedex[key] = PokedexEntry{Seen: time.Now()}
+	user["pokedex"] = pokedex
+	return true
+}
+
+// registerCaught marks species id as caught by user and announces any
+// completion milestone it crosses. Caller must hold s.mutex and persist
+// user.
+func (s *Server) registerCaught(user map[string]interface{}, id int) {
+	pokedex := decodePokedex(user["pokedex"])
+	key := strconv.Itoa(id)
+	entry, seen := pokedex[key]
+	if seen && entry.Caught != nil {
+		return
+	}
+
+	before := summarizePokedex(pokedex).CaughtPct
+	now := time.Now()
+	if !seen {
+		entry.Seen = now
+	}
+	entry.Caught = &now
+	pokedex[key] = entry
+	user["pokedex"] = pokedex
+	summary := summarizePokedex(pokedex)
+	after := summary.CaughtPct
+
+	clientID, _ := user["uID"].(string)
+	s.leaderboards.Set(BoardPokedex, clientID, summary.Caught)
+	for _, milestone := range pokedexMilestones {
+		if before < float64(milestone) && after >= float64(milestone) {
+			message := fmt.Sprintf("ACHIEVEMENT %s POKEDEX %d%%", clientID, milestone)
+			s.writeToClient(clientID, message)
+			s.publishLocked(achievementsChannel, message)
+		}
+	}
+}
+
+// UpdatePokedexViews marks every wild Pokemon within viewRadius of a
+// connected player as seen by them.
+func (s *Server) UpdatePokedexViews() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	pokemonWorldList, err := loadPokemonWorld()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	changed := false
+	for clientID := range s.clients {
+		user := findUser(A, clientID)
+		if user == nil {
+			continue
+		}
+		pos := userPosition(user)
+		for _, pokemonWorld := range pokemonWorldList.PokemonWorlds {
+			if distance(pos, pokemonWorld.Position) <= viewRadius && registerSeen(user, pokemonWorld.Pokemon.ID) {
+				s.writeToClient(clientID, fmt.Sprintf("POKEDEX SEEN %d", pokemonWorld.Pokemon.ID))
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := s.storeClientsData(A); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// SendPokedex writes the client's Pokedex and completion to conn.
+func (s *Server) SendPokedex(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		_, _ = conn.Write([]byte("POKEDEX ERROR " + err.Error() + "\n"))
+		return
+	}
+	data, _ := json.Marshal(summarizePokedex(decodePokedex(user["pokedex"])))
+	_, _ = conn.Write([]byte("POKEDEX " + string(data) + "\n"))
+}
@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,9 +17,43 @@ import (
 	"github.com/google/uuid"
 )
 
-func InitiatePoke() {
+// LoadCatalogs reads the game data: species, items, shops, quests,
+// trainers, anti-cheat settings and regions. main calls it before
+// NewServer starts the game loop; the catalogs are read-only afterwards,
+// which is why they are read without holding s.mutex.
+func LoadCatalogs() {
+	if err := LoadSpeciesCatalog(speciesFile); err != nil {
+		fmt.Println("Error loading species catalog:", err)
+	}
+
+	if err := LoadItemCatalog(itemsFile); err != nil {
+		fmt.Println("Error loading item catalog:", err)
+	}
+
+	if err := LoadShops(shopsFile); err != nil {
+		fmt.Println("Error loading shops:", err)
+	}
+
+	if err := LoadQuests(questsFile); err != nil {
+		fmt.Println("Error loading quests:", err)
+	}
+
+	if err := LoadTrainers(trainersFile); err != nil {
+		fmt.Println("Error loading trainers:", err)
+	}
 
+	if err := LoadAntiCheat(antiCheatFile); err != nil {
+		fmt.Println("Error loading anti-cheat settings:", err)
+	}
+
+	if err := LoadRegions(regionsFile); err != nil {
+		fmt.Println("Error loading regions:", err)
+	}
+}
+
+func InitiatePoke() {
 	pokemonWorldList := createRandomPokemonWorldList(50)
+	pokemonWorldList.Items = createRandomItemWorldList(20)
 
 	data, err := json.MarshalIndent(pokemonWorldList, "", "  ")
 	if err != nil {
@@ -33,6 +68,8 @@ func InitiatePoke() {
 	}
 }
 
+const pokemonWorldFile = "PokemonWorld.json"
+
 type Server struct {
 	channels            map[string]map[net.Conn]bool
 	clients             map[string]net.Conn
@@ -40,6 +77,26 @@ type Server struct {
 	jsonFile            string
 	broadcastTicker     *time.Ticker
 	broadcastTickerPoke *time.Ticker
+	encounters          map[string]*Encounter
+	battles             map[string]*Battle
+	pvpBattles          map[string]*PvPBattle
+	challenges          map[string]string // challenged player -> challenger
+	trades              map[string]*Trade
+	leaderboards        *Leaderboards
+	leaderboardTicker   *time.Ticker
+	worldTicker         *time.Ticker
+	raids               map[string]*Raid
+	raidTicker          *time.Ticker
+	retained            map[string]string // channel -> last retained message
+	trainerPatrols      map[string]*trainerPatrol
+	acls                map[string]*ChannelACL
+	limits              *RateLimits
+	logins              *LoginLimits
+	violations          map[string]map[string]int // clientID -> kind -> count
+	moves               map[string]int            // tiles each player moved themselves this tick
+	moderation          *Moderation
+	sayRadius           int
+	done                chan struct{} // closed by Close to stop the game loop
 }
 
 type Pokemon struct {
@@ -55,29 +112,36 @@ type Position struct {
 	Y int `json:"y"`
 }
 
+// PokemonWorld is a wild Pokemon on the map. Home is where it spawned; it
+// wanders around there.
 type PokemonWorld struct {
-	Pokemon  Pokemon  `json:"pokemon"`
-	Position Position `json:"position"`
+	Pokemon  Pokemon   `json:"pokemon"`
+	Position Position  `json:"position"`
+	Home     *Position `json:"home,omitempty"`
 }
 
 type PokemonWorldList struct {
 	PokemonWorlds []PokemonWorld `json:"PokemonWorld"`
+	Items         []ItemWorld    `json:"items"`
 }
 
 func createRandomPokemonWorld() PokemonWorld {
+	position := Position{
+		X: rand.Intn(mapSize),
+		Y: rand.Intn(mapSize),
+	}
+	home := position
 	return PokemonWorld{
-		Pokemon: createRandomPokemon(),
-		Position: Position{
-			X: rand.Intn(100),
-			Y: rand.Intn(100),
-		},
+		Pokemon:  createWildPokemon(position),
+		Position: position,
+		Home:     &home,
 	}
 }
 
 func createRandomPokemon() Pokemon {
 	return Pokemon{
 		UID: uuid.New().String(),
-		ID:  rand.Intn(898) + 1, // Random ID between 1 and 898
+		ID:  randomSpeciesID(),
 		Exp: 0,
 		EV:  0.5 + rand.Float64()*0.5,
 		LV:  rand.Intn(5) + 1,
@@ -102,101 +166,6 @@ func createRandomListPokemon(n int) []Pokemon {
 	return listPokemon
 }
 
-func (s *Server) IntegrateMatchingPokemonIntoClients() {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	// Load current clients' positions
-	clientsFile, err := os.Open(s.jsonFile)
-	if err != nil {
-		fmt.Printf("Error opening clients.json file: %v\n", err)
-		return
-	}
-	defer clientsFile.Close()
-
-	var clientsData map[string]interface{}
-	if err := json.NewDecoder(clientsFile).Decode(&clientsData); err != nil {
-		fmt.Printf("Error decoding clients.json file: %v\n", err)
-		return
-	}
-
-	// Load current Pokemon data
-	pokemonFile, err := os.Open("PokemonWorld.json")
-	if err != nil {
-		fmt.Printf("Error opening PokemonWorld.json file: %v\n", err)
-		return
-	}
-	defer pokemonFile.Close()
-
-	var pokemonWorldList PokemonWorldList
-	if err := json.NewDecoder(pokemonFile).Decode(&pokemonWorldList); err != nil {
-		fmt.Printf("Error decoding PokemonWorld.json file: %v\n", err)
-		return
-	}
-
-	// Check for matches and integrate Pokémon
-	for _, userInterface := range clientsData["user"].([]interface{}) {
-		user := userInterface.(map[string]interface{})
-		userPosX := int(user["positionX"].(float64))
-		userPosY := int(user["positionY"].(float64))
-
-		// Iterate over Pokemon, checking for matches with user positions
-		for i, pokemonWorld := range pokemonWorldList.PokemonWorlds {
-			if pokemonWorld.Position.X == userPosX && pokemonWorld.Position.Y == userPosY {
-				// Found a match, add this Pokemon to the user's listPokemon
-				pokemon := pokemonWorld.Pokemon
-
-				// Convert existing listPokemon to slice of Pokemon
-				var listPokemon []Pokemon
-				if user["listPokemon"] != nil {
-					for _, p := range user["listPokemon"].([]interface{}) {
-						pBytes, _ := json.Marshal(p)
-						var pokemonObj Pokemon
-						json.Unmarshal(pBytes, &pokemonObj)
-						listPokemon = append(listPokemon, pokemonObj)
-					}
-				}
-
-				listPokemon = append(listPokemon, pokemon)
-				user["listPokemon"] = listPokemon
-
-				// Remove this Pokemon from the PokemonWorldList since it's been integrated
-				pokemonWorldList.PokemonWorlds = append(pokemonWorldList.PokemonWorlds[:i], pokemonWorldList.PokemonWorlds[i+1:]...)
-				break
-			}
-		}
-	}
-
-	// Save the updated clients data back to the JSON file
-	clientsFile, err = os.Create(s.jsonFile)
-	if err != nil {
-		fmt.Printf("Error creating clients.json file: %v\n", err)
-		return
-	}
-	defer clientsFile.Close()
-
-	encoder := json.NewEncoder(clientsFile)
-	if err := encoder.Encode(clientsData); err != nil {
-		fmt.Printf("Error encoding clients data to JSON file: %v\n", err)
-		return
-	}
-
-	// Save the updated Pokemon data back to the JSON file
-	pokemonFile, err = os.Create("PokemonWorld.json")
-	if err != nil {
-		fmt.Printf("Error creating PokemonWorld.json file: %v\n", err)
-		return
-	}
-	defer pokemonFile.Close()
-
-	pokemonEncoder := json.NewEncoder(pokemonFile)
-	if err := pokemonEncoder.Encode(pokemonWorldList); err != nil {
-		fmt.Printf("Error encoding Pokemon data to JSON file: %v\n", err)
-		return
-	}
-	fmt.Println("complete####")
-}
-
 func NewServer(jsonFile string) *Server {
 	server := &Server{
 		channels:            make(map[string]map[net.Conn]bool),
@@ -204,18 +173,88 @@ func NewServer(jsonFile string) *Server {
 		jsonFile:            jsonFile,
 		broadcastTicker:     time.NewTicker(20 * time.Second),
 		broadcastTickerPoke: time.NewTicker(50 * time.Second),
-	}
+		encounters:          make(map[string]*Encounter),
+		battles:             make(map[string]*Battle),
+		pvpBattles:          make(map[string]*PvPBattle),
+		challenges:          make(map[string]string),
+		trades:              make(map[string]*Trade),
+		leaderboards:        NewLeaderboards(),
+		leaderboardTicker:   time.NewTicker(60 * time.Second),
+		worldTicker:         time.NewTicker(60 * time.Second),
+		retained:            make(map[string]string),
+		raids:               make(map[string]*Raid),
+		raidTicker:          time.NewTicker(raidInterval),
+		trainerPatrols:      make(map[string]*trainerPatrol),
+		acls:                make(map[string]*ChannelACL),
+		limits:              NewRateLimits(),
+		logins:              NewLoginLimits(),
+		violations:          make(map[string]map[string]int),
+		moves:               make(map[string]int),
+		moderation:          NewModeration(),
+		sayRadius:           DefaultSayRadius,
+		done:                make(chan struct{}),
+	}
+	if err := server.leaderboards.Load(leaderboardFile); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+	if err := server.moderation.Load(moderationFile); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+	if err := server.moderation.LoadWords(wordFilterFile); err != nil {
+		fmt.Println("Error loading word filter:", err)
+	}
+	server.retained[worldChannel] = worldMessage(worldState.Conditions())
 
 	go server.startBroadcasting()
+	go server.startLeaderboardBroadcast()
+	go server.startWorldClock()
+	go server.startRaidSchedule()
 	// go server.startBroadcastingPoke()
 	return server
 }
 
+// Close stops the game loop, the periodic broadcasts and the raid and PvP
+// turn timers. Connected clients are left to their handlers.
+func (s *Server) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	close(s.done)
+	for _, ticker := range []*time.Ticker{s.broadcastTicker, s.broadcastTickerPoke, s.leaderboardTicker, s.worldTicker, s.raidTicker} {
+		ticker.Stop()
+	}
+	for _, raid := range s.raids {
+		if raid.timer != nil {
+			raid.timer.Stop()
+		}
+	}
+	for _, battle := range s.pvpBattles {
+		if battle.timer != nil {
+			battle.timer.Stop()
+		}
+	}
+}
+
+// tick waits for ticker's next tick and reports false once the server is
+// closed.
+func (s *Server) tick(ticker *time.Ticker) bool {
+	select {
+	case <-ticker.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
 func (s *Server) startBroadcastingPoke() {
 
-	for range s.broadcastTicker.C {
+	for s.tick(s.broadcastTicker) {
 
-		s.BroadcastToAllClients("REPEAT GET PokemonWorld.json")
+		s.BroadcastToAllClients("REPEAT GET world")
 
 	}
 
@@ -223,16 +262,19 @@ func (s *Server) startBroadcastingPoke() {
 
 func (s *Server) startBroadcasting() {
 
-	for range s.broadcastTicker.C {
+	for s.tick(s.broadcastTicker) {
 		s.BroadcastToAllClients("This is a periodic message sent every 10 seconds.")
-		s.BroadcastToAllClients("REPEAT GET clients.json")
+		s.BroadcastToAllClients("REPEAT GET clients")
 
 		s.BroadcastToAllClients("This is a periodic message sent every 10 seconds.")
 
 		s.sendRandomDirectionToClients()
 		// Up Down Left Right (1, 2, 3, 4)
 		s.updateClientsPosition()
-		s.IntegrateMatchingPokemonIntoClients()
+		s.CollectItemPickups()
+		s.UpdatePokedexViews()
+		s.DetectEncounters()
+		s.MoveWildPokemon()
 	}
 
 }
@@ -264,14 +306,27 @@ func (s *Server) updateClientsPosition() {
 		A["user"] = []interface{}{}
 	}
 
+	before := s.trainerSightings()
+	s.patrolTrainers()
+
 	// Update the position for each client based on their direction
 	for clientID := range s.clients {
+		if _, busy := s.encounters[clientID]; busy {
+			continue // Players stay put while an encounter is open
+		}
+		if _, battling := s.battles[clientID]; battling {
+			continue // or while a trainer battles them
+		}
+		if s.moves[clientID] > 0 {
+			continue // or when they moved themselves this tick
+		}
 		for _, u := range A["user"].([]interface{}) {
 			user := u.(map[string]interface{})
 			if user["uID"] == clientID {
 				direction := int(user["direction"].(float64))
 				positionX := int(user["positionX"].(float64))
 				positionY := int(user["positionY"].(float64))
+				from := Position{X: positionX, Y: positionY}
 
 				switch direction {
 				case 1: // Up
@@ -283,27 +338,32 @@ func (s *Server) updateClientsPosition() {
 				case 4: // Right
 					positionX += 1
 				}
+				if !onMap(Position{X: positionX, Y: positionY}) {
+					break
+				}
 
 				user["positionX"] = positionX
 				user["positionY"] = positionY
+				s.walked(clientID, user, from, before)
 				break
 			}
 		}
 	}
+	s.moves = make(map[string]int)
 
-	// Encode and save the updated map A to JSON file
-	file, err = os.Create(s.jsonFile)
-	if err != nil {
-		fmt.Printf("Error creating clients.json file: %v\n", err)
-		return
+	// Save the updated map A, with any ledger entries the moves earned
+	if err := s.storeClientsData(A); err != nil {
+		fmt.Printf("%v\n", err)
 	}
-	defer file.Close()
+}
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(A); err != nil {
-		fmt.Printf("Error encoding clients data to JSON file: %v\n", err)
-		return
-	}
+// walked applies the effects of clientID taking a step from from. Caller
+// must hold s.mutex.
+func (s *Server) walked(clientID string, user map[string]interface{}, from Position, before map[string]trainerPatrol) {
+	s.awardExp(user, "", walkExp)
+	tickItemEffects(user)
+	s.emitGameEvent(user, GameEvent{Type: EventMove})
+	s.challengeByTrainer(clientID, user, from, before)
 }
 
 func (s *Server) sendRandomDirectionToClients() {
@@ -373,6 +433,18 @@ func (s *Server) BroadcastToAllClients(message string) {
 	}
 }
 
+// writeToClient sends message to a single connected client. Caller must
+// hold s.mutex.
+func (s *Server) writeToClient(clientID, message string) {
+	conn, exists := s.clients[clientID]
+	if !exists {
+		return
+	}
+	if _, err := conn.Write([]byte(message + "\n")); err != nil {
+		fmt.Printf("Error sending message to client %s: %v\n", clientID, err)
+	}
+}
+
 func (s *Server) saveToJSONFile(filename string, data interface{}) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -386,12 +458,134 @@ func (s *Server) saveToJSONFile(filename string, data interface{}) error {
 	return encoder.Encode(data)
 }
 
+// loadClientsData decodes s.jsonFile into a generic map with a "user" slice.
+// Caller must hold s.mutex.
+func (s *Server) loadClientsData() (map[string]interface{}, error) {
+	file, err := os.Open(s.jsonFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening clients.json file: %v", err)
+	}
+	defer file.Close()
+
+	var A map[string]interface{}
+	if err := json.NewDecoder(file).Decode(&A); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error decoding clients.json file: %v", err)
+	}
+	if A == nil {
+		A = make(map[string]interface{})
+	}
+	if A["user"] == nil {
+		A["user"] = []interface{}{}
+	}
+	return A, nil
+}
+
+// storeClientsData writes A back to s.jsonFile. Caller must hold s.mutex.
+func (s *Server) storeClientsData(A map[string]interface{}) error {
+	entries := takePendingLedger(A)
+	file, err := os.Create(s.jsonFile)
+	if err != nil {
+		return fmt.Errorf("error creating clients.json file: %v", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(A); err != nil {
+		return fmt.Errorf("error encoding clients data to JSON file: %v", err)
+	}
+	// Snapshots before the ledger: a crash in between loses ledger lines
+	// rather than leaving a credit that a rebuilt player gets again.
+	users, _ := A["user"].([]interface{})
+	snapshotErr := s.storeSnapshots(users)
+	for _, entry := range entries {
+		if err := appendLedger(entry); err != nil {
+			return err
+		}
+	}
+	return snapshotErr
+}
+
+// findUser returns the user entry of A whose uID is clientID, or nil.
+func findUser(A map[string]interface{}, clientID string) map[string]interface{} {
+	users, _ := A["user"].([]interface{})
+	for _, u := range users {
+		user, ok := u.(map[string]interface{})
+		if ok && user["uID"] == clientID {
+			return user
+		}
+	}
+	return nil
+}
+
+// decodeListPokemon converts a decoded JSON list back into Pokemon.
+func decodeListPokemon(v interface{}) []Pokemon {
+	if list, ok := v.([]Pokemon); ok {
+		return append([]Pokemon(nil), list...)
+	}
+	var listPokemon []Pokemon
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		pBytes, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		var pokemonObj Pokemon
+		if err := json.Unmarshal(pBytes, &pokemonObj); err == nil {
+			listPokemon = append(listPokemon, pokemonObj)
+		}
+	}
+	return listPokemon
+}
+
+func loadPokemonWorld() (PokemonWorldList, error) {
+	var pokemonWorldList PokemonWorldList
+	pokemonFile, err := os.Open(pokemonWorldFile)
+	if err != nil {
+		return pokemonWorldList, fmt.Errorf("error opening PokemonWorld.json file: %v", err)
+	}
+	defer pokemonFile.Close()
+
+	if err := json.NewDecoder(pokemonFile).Decode(&pokemonWorldList); err != nil {
+		return pokemonWorldList, fmt.Errorf("error decoding PokemonWorld.json file: %v", err)
+	}
+	return pokemonWorldList, nil
+}
+
+// removeWildPokemon deletes the Pokemon with uid from PokemonWorld.json.
+func removeWildPokemon(uid string) error {
+	pokemonWorldList, err := loadPokemonWorld()
+	if err != nil {
+		return err
+	}
+	for i, pokemonWorld := range pokemonWorldList.PokemonWorlds {
+		if pokemonWorld.Pokemon.UID == uid {
+			pokemonWorldList.PokemonWorlds = append(pokemonWorldList.PokemonWorlds[:i], pokemonWorldList.PokemonWorlds[i+1:]...)
+			break
+		}
+	}
+	return storePokemonWorld(pokemonWorldList)
+}
+
+func storePokemonWorld(pokemonWorldList PokemonWorldList) error {
+	pokemonFile, err := os.Create(pokemonWorldFile)
+	if err != nil {
+		return fmt.Errorf("error creating PokemonWorld.json file: %v", err)
+	}
+	defer pokemonFile.Close()
+
+	if err := json.NewEncoder(pokemonFile).Encode(pokemonWorldList); err != nil {
+		return fmt.Errorf("error encoding Pokemon data to JSON file: %v", err)
+	}
+	return nil
+}
+
 func (s *Server) removeClient(id string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	// Remove the client from the clients map
 	delete(s.clients, id)
+	delete(s.encounters, id)
+	delete(s.battles, id)
 	fmt.Println("Removed client: " + id)
 
 	// Open the JSON file
@@ -438,7 +632,10 @@ func (s *Server) removeClient(id string) {
 	fmt.Println("Client data removed from JSON file.")
 }
 
-func (s *Server) saveClients(list []Pokemon) error {
+// saveClients writes an entry for every connected client to clients.json.
+// A client without one gets snapshot when it is theirs, or a new player
+// with the starter party list.
+func (s *Server) saveClients(snapshot map[string]interface{}, list []Pokemon) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -464,7 +661,7 @@ func (s *Server) saveClients(list []Pokemon) error {
 	}
 
 	// Prepare the user array
-	users := make([]map[string]interface{}, 0, len(s.clients))
+	users := make([]interface{}, 0, len(s.clients))
 	for clientID, conn := range s.clients {
 		// Check if the client's uID exists in map A
 		userData := make(map[string]interface{})
@@ -479,20 +676,43 @@ func (s *Server) saveClients(list []Pokemon) error {
 		if len(userData) > 0 {
 			// Use existing data for this user
 			users = append(users, userData)
+		} else if snapshot != nil && snapshot["uID"] == clientID {
+			// Restore a returning player, with anything left in escrow
+			// by an unfinished trade back in their collection
+			releaseEscrow(snapshot)
+			snapshot["connAdd"] = conn.RemoteAddr().String()
+			users = append(users, snapshot)
 		} else {
 			// Generate new random values for positionX and positionY
 			positionX := rand.Intn(50)
 			positionY := rand.Intn(50)
 			direction := rand.Intn(4) + 1 // Up, Down, Left, Right (1, 2, 3, 4)
 			user := map[string]interface{}{
-				"uID":         clientID,
-				"connAdd":     conn.RemoteAddr().String(),
-				"positionX":   positionX,
-				"positionY":   positionY,
-				"listPokemon": []interface{}{list},
-				"maxValue":    "",
-				"spaceLeft":   "",
-				"direction":   direction,
+				"uID":       clientID,
+				"connAdd":   conn.RemoteAddr().String(),
+				"positionX": positionX,
+				"positionY": positionY,
+				"direction": direction,
+			}
+			newUserStorage(user, list)
+			for _, p := range list {
+				s.registerCaught(user, p.ID)
+				s.leaderboards.Max(BoardLevel, clientID, p.LV)
+			}
+			// A player rebuilt without a snapshot keeps the balance the
+			// ledger gives them and gets no second starter grant
+			balance, played, err := ledgerBalance(clientID)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			}
+			if played {
+				user["balance"] = balance
+				user["items"] = map[string]int{}
+			} else {
+				newUserItems(user)
+				if _, err := adjustBalance(user, starterBalance, "starter"); err != nil {
+					fmt.Printf("Error crediting starter balance: %v\n", err)
+				}
 			}
 			users = append(users, user)
 		}
@@ -501,35 +721,29 @@ func (s *Server) saveClients(list []Pokemon) error {
 	// Update map A with the new users' data
 	A["user"] = users
 
-	// Encode and save map A to JSON file
-	file, err = os.Create(s.jsonFile)
-	if err != nil {
-		return fmt.Errorf("error creating clients.json file: %v", err)
-	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(A); err != nil {
-		return fmt.Errorf("error encoding clients data to JSON file: %v", err)
-	}
-
-	return nil
+	// Save map A, which records new players' starter balance in the ledger
+	return s.storeClientsData(A)
 }
 
-func (s *Server) addClient(conn net.Conn, list []Pokemon) string {
-	id := uuid.New().String()
+func (s *Server) addClient(conn net.Conn, id string, snapshot map[string]interface{}, list []Pokemon) error {
+	if ban, banned := s.moderation.Banned(BanAccount, id); banned {
+		return fmt.Errorf("banned %s", ban.describe())
+	}
 	s.mutex.Lock()
+	if _, online := s.clients[id]; online {
+		s.mutex.Unlock()
+		return errAlreadyOnline
+	}
 	s.clients[id] = conn
 	s.mutex.Unlock()
 
 	// Save the client's data including positionX and positionY
-	err := s.saveClients(list)
+	err := s.saveClients(snapshot, list)
 	if err != nil {
 		fmt.Printf("Error saving client data: %v\n", err)
 	}
 
-	//s.broadcastClientsJSON(s.jsonFile)
-	return id
+	return nil
 }
 
 func (s *Server) showClients() {
@@ -541,13 +755,20 @@ func (s *Server) showClients() {
 	}
 }
 
-func (s *Server) AddSubscriber(channel string, conn net.Conn) {
+// AddSubscriber subscribes conn to channel if the channel's ACL lets the
+// client on conn read it.
+func (s *Server) AddSubscriber(channel string, conn net.Conn) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if !s.aclFor(channel).canSubscribe(s.clientIDOf(conn)) {
+		return errNotAllowed
+	}
 	if _, exists := s.channels[channel]; !exists {
 		s.channels[channel] = make(map[net.Conn]bool)
 	}
 	s.channels[channel][conn] = true
+	s.sendRetained(channel, conn)
+	return nil
 }
 
 func (s *Server) RemoveSubscriber(channel string, conn net.Conn) {
@@ -579,6 +800,11 @@ func (s *Server) BroadcastMessage(channel, message string) {
 func (s *Server) PublishMessage(channel, message string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.publishLocked(channel, message)
+}
+
+// publishLocked is PublishMessage for callers that already hold s.mutex.
+func (s *Server) publishLocked(channel, message string) {
 	if subscribers, exists := s.channels[channel]; exists {
 		for conn := range subscribers {
 			_, err := conn.Write([]byte(message + "\n"))
@@ -593,6 +819,7 @@ func (s *Server) DeleteChannel(channel string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	delete(s.channels, channel)
+	delete(s.acls, channel)
 	fmt.Printf("Channel %s deleted\n", channel)
 }
 
@@ -630,56 +857,32 @@ func (s *Server) ShowChannels(conn net.Conn) int {
 	return counter
 } // for Client request print into console
 
-func (s *Server) broadcastClientsJSON(fileName string) {
-
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	// Open the clients.json file
-	file, err := os.Open(fileName)
-	if err != nil {
-		fmt.Printf("Error opening clients.json file: %v\n", err)
-		return
-	}
-	defer file.Close()
-
-	// Read the file content
-	fileContent, err := io.ReadAll(file)
-	if err != nil {
-		fmt.Printf("Error reading"+s.jsonFile+" file: %v\n", err)
-		return
-	}
-
-	// Broadcast the file content to all connected clients
-	for _, conn := range s.clients {
-		_, err := conn.Write(fileContent)
-		if err != nil {
-			fmt.Printf("Error sending clients.json contents to client: %v\n", err)
-			// Optionally, handle disconnections if necessary
-			conn.Close()
-			delete(s.clients, conn.RemoteAddr().String())
-		}
-	}
-} // sent file to Client
-
 func (s *Server) HandleConnection(conn net.Conn) {
 
 	defer conn.Close()
 
-	// Random Pokemon List
-
-	list := createRandomListPokemon(3)
-
-	clientID := s.addClient(conn, list)
-	s.BroadcastToAllClients("REPEAT GET clients.json")
+	// Only authenticated connections become players
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 1024), maxLineSize)
+	connection := newTokenBucket(connectionRate, connectionBurst)
+	clientID, ok := s.authenticate(conn, scanner, connection)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	s.sendRetained(worldChannel, conn)
+	s.deliverMail(clientID)
+	s.mutex.Unlock()
+	s.BroadcastToAllClients("REPEAT GET clients")
 	defer func() {
+		s.ForfeitPvP(clientID)
+		s.CancelTrade(clientID)
+		s.LeaveRaid(clientID)
+		s.saveSnapshot(clientID)
 		s.removeClient(clientID)
-		s.BroadcastToAllClients("REPEAT GET clients.json")
+		s.BroadcastToAllClients("REPEAT GET clients")
 	}()
 
-	//s.broadcastClientsJSON(s.jsonFile)
-
-	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
 		line := scanner.Text()
 		parts := strings.SplitN(line, " ", 10)
@@ -687,13 +890,23 @@ func (s *Server) HandleConnection(conn net.Conn) {
 		command := parts[0]
 		fmt.Println(command)
 
+		allowed, kicked := s.allowCommand(clientID, connection, command)
+		if kicked {
+			return
+		}
+		if !allowed || !s.validateAction(clientID, parts) {
+			continue
+		}
+
 		switch command {
 		case "SUBSCRIBE":
 			if len(parts) < 2 {
 				continue
 			}
 			channel := parts[1]
-			s.AddSubscriber(channel, conn)
+			if err := s.AddSubscriber(channel, conn); err != nil {
+				_, _ = conn.Write([]byte("SUBSCRIBE ERROR " + channel + " " + err.Error() + "\n"))
+			}
 		case "PUBLISH":
 			if len(parts) < 2 {
 				continue
@@ -705,7 +918,32 @@ func (s *Server) HandleConnection(conn net.Conn) {
 				message += parts[i] + " "
 			}
 			fmt.Println(message)
-			s.PublishMessage(channel, message)
+			if err := s.PublishMessageFrom(clientID, channel, message); err != nil {
+				_, _ = conn.Write([]byte("PUBLISH ERROR " + channel + " " + err.Error() + "\n"))
+			}
+		case "WHISPER":
+			// Keep the message's spacing as typed
+			args := strings.SplitN(line, " ", 3)
+			if len(args) < 3 {
+				_, _ = conn.Write([]byte("Usage: WHISPER <player> <message>\n"))
+				continue
+			}
+			s.Whisper(clientID, conn, args[1], args[2])
+		case "SAY":
+			args := strings.SplitN(line, " ", 2)
+			if len(args) < 2 {
+				_, _ = conn.Write([]byte("Usage: SAY <message>\n"))
+				continue
+			}
+			s.Say(clientID, conn, args[1])
+		case "BLOCK", "UNBLOCK":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: " + command + " <player>\n"))
+				continue
+			}
+			s.Block(clientID, conn, parts[1], command == "UNBLOCK")
+		case "BLOCKS":
+			s.SendBlocks(clientID, conn)
 		case "UNSUBSCRIBE":
 			if len(parts) < 2 {
 				continue
@@ -722,24 +960,172 @@ func (s *Server) HandleConnection(conn net.Conn) {
 		case "EXIT":
 			fmt.Println("Exiting...")
 			fmt.Println(clientID)
-			s.removeClient(clientID)
-			fmt.Println("Exiting.")
-			s.broadcastClientsJSON(s.jsonFile)
-			fmt.Println("Exiting..")
-
-			return // Exit the loop and close connection
+			return // The deferred cleanup saves and removes the client
+		case "THROW":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: THROW <ballType>\n"))
+				continue
+			}
+			s.ThrowBall(clientID, conn, parts[1])
+		case "RUN":
+			s.RunFromEncounter(clientID, conn)
+		case "MOVE":
+			if len(parts) < 3 {
+				_, _ = conn.Write([]byte("Usage: MOVE <x> <y>\n"))
+				continue
+			}
+			s.MovePlayer(clientID, parts[1], parts[2])
+		case "BATTLE":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: BATTLE START|MOVE <n>|SWITCH <uid>|FLEE\n"))
+				continue
+			}
+			if parts[1] == "START" {
+				s.StartBattle(clientID, conn)
+				continue
+			}
+			arg := ""
+			if len(parts) > 2 {
+				arg = parts[2]
+			}
+			s.HandleBattleCommand(clientID, conn, parts[1], arg)
+		case "CHALLENGE":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: CHALLENGE <playerID>\n"))
+				continue
+			}
+			s.Challenge(clientID, conn, parts[1])
+		case "TRADE":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: TRADE OFFER <player> <uid...>|CONFIRM|CANCEL\n"))
+				continue
+			}
+			switch parts[1] {
+			case "OFFER":
+				if len(parts) < 3 {
+					_, _ = conn.Write([]byte("Usage: TRADE OFFER <player> <uid...>\n"))
+					continue
+				}
+				s.OfferTrade(clientID, conn, parts[2], parts[3:])
+			case "CONFIRM":
+				s.ConfirmTrade(clientID, conn)
+			case "CANCEL":
+				s.CancelTrade(clientID)
+			}
+		case "PARTY":
+			s.SendParty(clientID, conn)
+		case "BOX":
+			n := ""
+			if len(parts) > 1 {
+				n = parts[1]
+			}
+			s.SendBox(clientID, conn, n)
+		case "DEPOSIT":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: DEPOSIT <uid> [box]\n"))
+				continue
+			}
+			box := ""
+			if len(parts) > 2 {
+				box = parts[2]
+			}
+			s.Deposit(clientID, conn, parts[1], box)
+		case "WITHDRAW":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: WITHDRAW <uid>\n"))
+				continue
+			}
+			s.Withdraw(clientID, conn, parts[1])
+		case "ITEMS":
+			s.SendItems(clientID, conn)
+		case "USE":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: USE <item> [target]\n"))
+				continue
+			}
+			target := ""
+			if len(parts) > 2 {
+				target = parts[2]
+			}
+			s.UseItem(clientID, conn, parts[1], target)
+		case "BALANCE":
+			s.SendBalance(clientID, conn)
+		case "SHOP":
+			if len(parts) < 2 || parts[1] != "LIST" {
+				_, _ = conn.Write([]byte("Usage: SHOP LIST\n"))
+				continue
+			}
+			s.SendShopList(clientID, conn)
+		case "BUY":
+			if len(parts) < 3 {
+				_, _ = conn.Write([]byte("Usage: BUY <item> <qty>\n"))
+				continue
+			}
+			s.Buy(clientID, conn, parts[1], parts[2])
+		case "POKEDEX":
+			s.SendPokedex(clientID, conn)
+		case "QUESTS":
+			s.SendQuests(clientID, conn)
+		case "QUEST":
+			if len(parts) < 3 || parts[1] != "CLAIM" {
+				_, _ = conn.Write([]byte("Usage: QUEST CLAIM <id>\n"))
+				continue
+			}
+			s.ClaimQuest(clientID, conn, parts[2])
+		case "CHANNEL":
+			s.HandleChannelCommand(clientID, conn, parts[1:])
+		case "TOP":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: TOP <board> <n>\n"))
+				continue
+			}
+			n := ""
+			if len(parts) > 2 {
+				n = parts[2]
+			}
+			s.SendTop(conn, parts[1], n)
+		case "RAID":
+			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: RAID LIST|JOIN <id>|ATTACK <n>|LEAVE\n"))
+				continue
+			}
+			switch parts[1] {
+			case "LIST":
+				s.SendRaids(conn)
+			case "JOIN":
+				if len(parts) < 3 {
+					_, _ = conn.Write([]byte("Usage: RAID JOIN <id>\n"))
+					continue
+				}
+				s.JoinRaid(clientID, conn, parts[2])
+			case "ATTACK":
+				if len(parts) < 3 {
+					_, _ = conn.Write([]byte("Usage: RAID ATTACK <n>\n"))
+					continue
+				}
+				s.RaidAttack(clientID, conn, parts[2])
+			case "LEAVE":
+				s.LeaveRaid(clientID)
+			}
+		case "ACCEPT":
+			s.AnswerChallenge(clientID, conn, true)
+		case "DECLINE":
+			s.AnswerChallenge(clientID, conn, false)
 		case "GET":
 			if len(parts) < 2 {
+				_, _ = conn.Write([]byte("Usage: GET <resource> [args]\n"))
 				continue
 			}
-			fileName := parts[1]
-			s.broadcastClientsJSON(fileName)
+			s.SendResource(conn, parts[1], parts[2:])
 
 		}
 
 	}
 
 	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			_, _ = conn.Write([]byte(fmt.Sprintf("LINE TOO LONG max %d bytes\n", maxLineSize)))
+		}
 		fmt.Printf("Error reading from connection: %v\n", err)
 	}
 
@@ -762,12 +1148,11 @@ func HandleServerCommands(server *Server) {
 				continue
 			}
 			channel := parts[1]
-			// Initialize the channel with an empty map of subscribers
-			server.mutex.Lock()
-			if _, exists := server.channels[channel]; !exists {
-				server.channels[channel] = make(map[net.Conn]bool)
+			// Console channels are broadcast channels only the server posts to
+			if err := server.CreateChannel(serverOwner, channel, ModeBroadcast); err != nil {
+				fmt.Println(err)
+				continue
 			}
-			server.mutex.Unlock()
 			fmt.Printf("Channel %s created\n", channel)
 		case "PUBLISH":
 			if len(parts) < 3 {
@@ -786,6 +1171,65 @@ func HandleServerCommands(server *Server) {
 			server.DeleteChannel(channel)
 		case "SHOWCHANNEL":
 			server.ShowChannelsInConsole()
+		case "CHANNEL":
+			args := parts[1:]
+			if len(parts) > 2 {
+				args = append([]string{parts[1]}, strings.Fields(parts[2])...)
+			}
+			server.ChannelCommandInConsole(args)
+		case "TOP":
+			if len(parts) < 2 {
+				fmt.Println("Usage: TOP <board> <n>")
+				continue
+			}
+			n := ""
+			if len(parts) > 2 {
+				n = parts[2]
+			}
+			server.ShowTopInConsole(parts[1], n)
+		case "RAID":
+			if len(parts) < 3 {
+				fmt.Println("Usage: RAID <speciesID> <level>")
+				continue
+			}
+			id, err := strconv.Atoi(parts[1])
+			level, levelErr := strconv.Atoi(parts[2])
+			if err != nil || levelErr != nil {
+				fmt.Println("Usage: RAID <speciesID> <level>")
+				continue
+			}
+			raid, err := server.StartRaid(id, level)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Raid %s started at %d,%d\n", raid.ID, raid.Position.X, raid.Position.Y)
+		case "LEDGER":
+			if len(parts) < 2 {
+				fmt.Println("Usage: LEDGER <clientID>")
+				continue
+			}
+			server.AuditLedger(parts[1])
+		case "ROLLBACK":
+			if len(parts) < 2 {
+				fmt.Println("Usage: ROLLBACK <entryID>")
+				continue
+			}
+			server.RollbackLedgerEntry(parts[1])
+		case "LIMITS":
+			clientID := ""
+			if len(parts) > 1 {
+				clientID = parts[1]
+			}
+			server.ShowLimitsInConsole(clientID)
+		case "VIOLATIONS":
+			clientID := ""
+			if len(parts) > 1 {
+				clientID = parts[1]
+			}
+			server.ShowViolationsInConsole(clientID)
+		case "KICK", "BAN", "UNBAN", "BANS", "MUTE", "UNMUTE", "FILTER":
+			server.ModerationCommandInConsole(command, strings.Fields(strings.Join(parts[1:], " ")))
 		default:
 			fmt.Println("Unknown command")
 		}
@@ -0,0 +1,90 @@
+package PubSub
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordConn is a connection that keeps every line written to it.
+type recordConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	written strings.Builder
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.written.Write(b)
+}
+
+func (c *recordConn) Close() error         { return nil }
+func (c *recordConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (c *recordConn) lines() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return strings.Split(strings.TrimSuffix(c.written.String(), "\n"), "\n")
+}
+
+// lastLine returns the last line written to c.
+func (c *recordConn) lastLine() string {
+	lines := c.lines()
+	return lines[len(lines)-1]
+}
+
+// chdirTemp moves the test into a new temporary directory, where the
+// server's data files are read and written, and moves back when it ends.
+// It does what t.Chdir does, which needs a newer go directive.
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// newTestServer starts a server on empty data files in a temporary
+// directory and closes it when the test ends.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	chdirTemp(t)
+	if err := os.WriteFile("clients.json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("clients.json")
+	t.Cleanup(s.Close)
+	return s
+}
+
+// addTestPlayer stores a player with party at pos in s's clients.json and
+// connects them on a recordConn.
+func addTestPlayer(t *testing.T, s *Server, clientID string, pos Position, party []Pokemon) *recordConn {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	A, err := s.loadClientsData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := map[string]interface{}{"uID": clientID, "positionX": pos.X, "positionY": pos.Y}
+	newUserStorage(user, party)
+	A["user"] = append(A["user"].([]interface{}), user)
+	if err := s.storeClientsData(A); err != nil {
+		t.Fatal(err)
+	}
+	conn := &recordConn{}
+	s.clients[clientID] = conn
+	return conn
+}
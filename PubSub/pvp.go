@@ -0,0 +1,470 @@
+package PubSub
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	pvpTurnTimeout = 30 * time.Second
+	maxPvPTimeouts = 3 // turns in a row a side may miss before it forfeits
+)
+
+var errNotYourBattle = errors.New("not in this battle")
+
+// pvpAction is a side's choice for the current turn: a 1-based move or the
+// uid of a party member to switch in.
+type pvpAction struct {
+	Move   int
+	Switch string
+}
+
+type pvpSide struct {
+	ClientID string     `json:"clientID"`
+	Party    []*Battler `json:"party"`
+	Active   int        `json:"active"`
+	Timeouts int        `json:"timeouts"` // turns missed in a row
+	action   *pvpAction
+}
+
+func (side *pvpSide) active() *Battler {
+	return side.Party[side.Active]
+}
+
+// replaceFainted sends out the next healthy party member and reports
+// whether one was left.
+func (side *pvpSide) replaceFainted() (string, bool) {
+	for i, battler := range side.Party {
+		if !battler.fainted() {
+			side.Active = i
+			return fmt.Sprintf("BATTLE SENT %s %s", side.ClientID, battler.Pokemon.UID), true
+		}
+	}
+	return "", false
+}
+
+// PvPBattle is a fight between two players who pick their actions
+// simultaneously each turn. Like Battle, all randomness comes from rng.
+type PvPBattle struct {
+	ID      string      `json:"id"`
+	Channel string      `json:"channel"`
+	Sides   [2]*pvpSide `json:"sides"`
+	Turn    int         `json:"turn"`
+	Winner  string      `json:"winner"`
+	Drawn   bool        `json:"drawn"`
+	rng     *rand.Rand
+	timer   *time.Timer
+}
+
+func NewPvPBattle(id, challengerID, targetID string, challengerParty, targetParty []Pokemon, seed int64) (*PvPBattle, error) {
+	if len(challengerParty) == 0 || len(targetParty) == 0 {
+		return nil, errNoPokemon
+	}
+	b := &PvPBattle{
+		ID:      id,
+		Channel: "battle-" + id,
+		Turn:    1,
+		rng:     rand.New(rand.NewSource(seed)),
+		Sides: [2]*pvpSide{
+			{ClientID: challengerID},
+			{ClientID: targetID},
+		},
+	}
+	for _, p := range challengerParty {
+		b.Sides[0].Party = append(b.Sides[0].Party, newBattler(p))
+	}
+	for _, p := range targetParty {
+		b.Sides[1].Party = append(b.Sides[1].Party, newBattler(p))
+	}
+	return b, nil
+}
+
+// over reports whether the battle has a winner or ended in a draw.
+func (b *PvPBattle) over() bool {
+	return b.Winner != "" || b.Drawn
+}
+
+// sides returns clientID's side followed by the opponent's.
+func (b *PvPBattle) sides(clientID string) (*pvpSide, *pvpSide, error) {
+	switch clientID {
+	case b.Sides[0].ClientID:
+		return b.Sides[0], b.Sides[1], nil
+	case b.Sides[1].ClientID:
+		return b.Sides[1], b.Sides[0], nil
+	}
+	return nil, nil, errNotYourBattle
+}
+
+// Choose records clientID's action for this turn.
+func (b *PvPBattle) Choose(clientID string, action pvpAction) error {
+	if b.over() {
+		return errBattleOver
+	}
+	own, _, err := b.sides(clientID)
+	if err != nil {
+		return err
+	}
+
+	if action.Switch != "" {
+		for i, battler := range own.Party {
+			if battler.Pokemon.UID == action.Switch && i != own.Active && !battler.fainted() {
+				own.action = &action
+				return nil
+			}
+		}
+		return errInvalidSwitch
+	}
+	if action.Move < 1 || action.Move > len(own.active().Moves) {
+		return errInvalidMove
+	}
+	own.action = &action
+	return nil
+}
+
+func (b *PvPBattle) ready() bool {
+	return b.Sides[0].action != nil && b.Sides[1].action != nil
+}
+
+// ResolveTurn plays the chosen actions. Switches happen before moves and
+// the faster active Pokemon moves first. A side that did not choose in
+// time loses its turn, and forfeits after maxPvPTimeouts turns in a row;
+// when both sides reach that the battle is a draw.
+func (b *PvPBattle) ResolveTurn() []string {
+	events := []string{fmt.Sprintf("BATTLE TURN %d", b.Turn)}
+
+	for _, side := range b.Sides {
+		if side.action == nil {
+			side.Timeouts++
+			events = append(events, "BATTLE TIMEOUT "+side.ClientID)
+			continue
+		}
+		side.Timeouts = 0
+		if side.action.Switch == "" {
+			continue
+		}
+		for i, battler := range side.Party {
+			if battler.Pokemon.UID == side.action.Switch {
+				side.Active = i
+			}
+		}
+		events = append(events, fmt.Sprintf("BATTLE SENT %s %s", side.ClientID, side.action.Switch))
+	}
+
+	idle0, idle1 := b.Sides[0].Timeouts >= maxPvPTimeouts, b.Sides[1].Timeouts >= maxPvPTimeouts
+	switch {
+	case idle0 && idle1:
+		b.Drawn = true
+		return append(events, "BATTLE DRAW")
+	case idle0:
+		return append(events, b.Forfeit(b.Sides[0].ClientID)...)
+	case idle1:
+		return append(events, b.Forfeit(b.Sides[1].ClientID)...)
+	}
+
+	order := []int{0, 1}
+	if b.Sides[1].active().Stats.Speed > b.Sides[0].active().Stats.Speed {
+		order = []int{1, 0}
+	}
+	for _, i := range order {
+		attacker, defender := b.Sides[i], b.Sides[1-i]
+		if attacker.action == nil || attacker.action.Switch != "" || attacker.active().fainted() {
+			continue
+		}
+		move := attacker.active().Moves[attacker.action.Move-1]
+		events = append(events, attack(b.rng, attacker.active(), defender.active(), move, attacker.ClientID))
+		if !defender.active().fainted() {
+			continue
+		}
+
+		events = append(events, "BATTLE FAINTED "+defender.active().Pokemon.UID)
+		sent, ok := defender.replaceFainted()
+		if !ok {
+			b.Winner = attacker.ClientID
+			return append(events, "BATTLE WINNER "+attacker.ClientID)
+		}
+		events = append(events, sent)
+		break // the replacement does not act this turn
+	}
+
+	b.Sides[0].action, b.Sides[1].action = nil, nil
+	b.Turn++
+	return events
+}
+
+// Forfeit ends the battle in favour of clientID's opponent.
+func (b *PvPBattle) Forfeit(clientID string) []string {
+	_, opponent, err := b.sides(clientID)
+	if err != nil || b.over() {
+		return nil
+	}
+	b.Winner = opponent.ClientID
+	return []string{"BATTLE FORFEIT " + clientID, "BATTLE WINNER " + opponent.ClientID}
+}
+
+// Challenge asks target to a battle. The target answers with ACCEPT or
+// DECLINE.
+func (s *Server) Challenge(clientID string, conn net.Conn, target string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	targetConn, online := s.clients[target]
+	switch {
+	case !online || target == clientID:
+		_, _ = conn.Write([]byte("CHALLENGE ERROR unknown player\n"))
+		return
+	case s.busy(clientID) || s.busy(target):
+		_, _ = conn.Write([]byte("CHALLENGE ERROR player busy\n"))
+		return
+	}
+
+	s.challenges[target] = clientID
+	_, _ = conn.Write([]byte("CHALLENGE SENT " + target + "\n"))
+	_, _ = targetConn.Write([]byte("CHALLENGED BY " + clientID + "\n"))
+}
+
+// inBattle reports whether clientID is in any battle or raid. Caller must
+// hold s.mutex.
+func (s *Server) inBattle(clientID string) bool {
+	_, wild := s.battles[clientID]
+	_, pvp := s.pvpBattles[clientID]
+	return wild || pvp || s.raidOf(clientID) != nil
+}
+
+// busy reports whether clientID has an open encounter or is in any battle
+// or raid. Caller must hold s.mutex.
+func (s *Server) busy(clientID string) bool {
+	_, encounter := s.encounters[clientID]
+	return encounter || s.inBattle(clientID)
+}
+
+// AnswerChallenge accepts or declines the client's pending challenge. On
+// accept both players are subscribed to the battle's spectator channel.
+func (s *Server) AnswerChallenge(clientID string, conn net.Conn, accept bool) {
+	battle, challengerConn, err := s.answerChallenge(clientID, accept)
+	if err != nil {
+		_, _ = conn.Write([]byte("CHALLENGE ERROR " + err.Error() + "\n"))
+		return
+	}
+	if battle == nil {
+		return
+	}
+
+	err = s.AddSubscriber(battle.Channel, challengerConn)
+	if err == nil {
+		err = s.AddSubscriber(battle.Channel, conn)
+	}
+	if err != nil {
+		s.cancelPvP(battle)
+		line := "CHALLENGE ERROR " + err.Error() + "\n"
+		_, _ = challengerConn.Write([]byte(line))
+		_, _ = conn.Write([]byte(line))
+		return
+	}
+	s.PublishMessage(battle.Channel, fmt.Sprintf("BATTLE PVP STARTED %s %s %s", battle.ID, battle.Sides[0].ClientID, battle.Sides[1].ClientID))
+	s.PublishMessage(worldEventsChannel, fmt.Sprintf("PVP STARTED %s %s", battle.ID, battle.Channel))
+}
+
+func (s *Server) answerChallenge(clientID string, accept bool) (*PvPBattle, net.Conn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	challengerID, pending := s.challenges[clientID]
+	if !pending {
+		return nil, nil, errors.New("no pending challenge")
+	}
+	delete(s.challenges, clientID)
+
+	challengerConn, online := s.clients[challengerID]
+	if !online {
+		return nil, nil, errors.New("challenger left")
+	}
+	if !accept {
+		_, _ = challengerConn.Write([]byte("CHALLENGE DECLINED " + clientID + "\n"))
+		return nil, nil, nil
+	}
+	if s.busy(clientID) || s.busy(challengerID) {
+		return nil, nil, errors.New("player busy")
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		return nil, nil, err
+	}
+	challenger, target := findUser(A, challengerID), findUser(A, clientID)
+	if challenger == nil || target == nil {
+		return nil, nil, errors.New("unknown player")
+	}
+
+	battle, err := NewPvPBattle(uuid.New().String()[:8], challengerID, clientID,
+		decodeListPokemon(challenger["listPokemon"]), decodeListPokemon(target["listPokemon"]), time.Now().UnixNano())
+	if err != nil {
+		return nil, nil, err
+	}
+	s.pvpBattles[challengerID] = battle
+	s.pvpBattles[clientID] = battle
+	s.scheduleTurnTimeout(battle)
+	return battle, challengerConn, nil
+}
+
+// cancelPvP drops a battle that could not start.
+func (s *Server) cancelPvP(battle *PvPBattle) {
+	s.mutex.Lock()
+	if battle.timer != nil {
+		battle.timer.Stop()
+	}
+	for _, side := range battle.Sides {
+		delete(s.pvpBattles, side.ClientID)
+	}
+	s.mutex.Unlock()
+	s.DeleteChannel(battle.Channel)
+}
+
+// scheduleTurnTimeout resolves the current turn after pvpTurnTimeout even
+// if a side has not chosen. Caller must hold s.mutex.
+func (s *Server) scheduleTurnTimeout(battle *PvPBattle) {
+	if battle.timer != nil {
+		battle.timer.Stop()
+	}
+	turn := battle.Turn
+	battle.timer = time.AfterFunc(pvpTurnTimeout, func() {
+		s.resolvePvPTurn(battle, turn)
+	})
+}
+
+func (s *Server) resolvePvPTurn(battle *PvPBattle, turn int) {
+	s.mutex.Lock()
+	if battle.Turn != turn || battle.over() {
+		s.mutex.Unlock()
+		return
+	}
+	events := battle.ResolveTurn()
+	s.afterPvPTurn(battle)
+	s.mutex.Unlock()
+
+	s.publishPvPEvents(battle, events)
+}
+
+// afterPvPTurn schedules the next turn or wraps up a finished battle.
+// Caller must hold s.mutex.
+func (s *Server) afterPvPTurn(battle *PvPBattle) {
+	if !battle.over() {
+		s.scheduleTurnTimeout(battle)
+		return
+	}
+	if battle.timer != nil {
+		battle.timer.Stop()
+	}
+	for _, side := range battle.Sides {
+		delete(s.pvpBattles, side.ClientID)
+	}
+	if battle.Drawn {
+		return
+	}
+
+	winner, loser, _ := battle.sides(battle.Winner)
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	if user := findUser(A, winner.ClientID); user != nil {
+		s.awardExp(user, winner.active().Pokemon.UID, expYield(loser.active().Pokemon))
+		s.reward(user, pvpReward, "pvp "+battle.ID)
+		s.emitGameEvent(user, GameEvent{Type: EventBattleWon, SpeciesID: loser.active().Pokemon.ID})
+		if err := s.storeClientsData(A); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	}
+}
+
+func (s *Server) publishPvPEvents(battle *PvPBattle, events []string) {
+	for _, event := range events {
+		s.PublishMessage(battle.Channel, event)
+	}
+	switch {
+	case battle.Drawn:
+		s.PublishMessage(worldEventsChannel, fmt.Sprintf("PVP DRAW %s %s", battle.Sides[0].ClientID, battle.Sides[1].ClientID))
+		s.DeleteChannel(battle.Channel)
+	case battle.Winner != "":
+		_, loser, _ := battle.sides(battle.Winner)
+		s.PublishMessage(worldEventsChannel, fmt.Sprintf("PVP WON %s %s", battle.Winner, loser.ClientID))
+		s.DeleteChannel(battle.Channel)
+	}
+}
+
+// HandlePvPCommand runs BATTLE MOVE/SWITCH/FLEE for a player in a PvP
+// battle. FLEE forfeits.
+func (s *Server) HandlePvPCommand(clientID string, conn net.Conn, action, arg string) {
+	s.mutex.Lock()
+	battle, exists := s.pvpBattles[clientID]
+	if !exists {
+		s.mutex.Unlock()
+		_, _ = conn.Write([]byte("BATTLE ERROR no battle\n"))
+		return
+	}
+
+	var err error
+	var events []string
+	switch action {
+	case "MOVE":
+		n, convErr := strconv.Atoi(arg)
+		if convErr != nil {
+			err = errInvalidMove
+			break
+		}
+		err = battle.Choose(clientID, pvpAction{Move: n})
+	case "SWITCH":
+		err = battle.Choose(clientID, pvpAction{Switch: arg})
+	case "FLEE":
+		events = battle.Forfeit(clientID)
+	default:
+		err = errors.New("unknown battle action " + action)
+	}
+
+	if err == nil && events == nil && battle.ready() {
+		events = battle.ResolveTurn()
+	}
+	if err == nil && events != nil {
+		s.afterPvPTurn(battle)
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		_, _ = conn.Write([]byte("BATTLE ERROR " + err.Error() + "\n"))
+		return
+	}
+	if events == nil {
+		_, _ = conn.Write([]byte("BATTLE WAITING\n"))
+		return
+	}
+	s.publishPvPEvents(battle, events)
+}
+
+// ForfeitPvP drops clientID's pending challenges and forfeits any battle
+// they are in, e.g. when they disconnect.
+func (s *Server) ForfeitPvP(clientID string) {
+	s.mutex.Lock()
+	delete(s.challenges, clientID)
+	for target, challenger := range s.challenges {
+		if challenger == clientID {
+			delete(s.challenges, target)
+		}
+	}
+	battle, exists := s.pvpBattles[clientID]
+	var events []string
+	if exists {
+		events = battle.Forfeit(clientID)
+		s.afterPvPTurn(battle)
+	}
+	s.mutex.Unlock()
+
+	if exists {
+		s.publishPvPEvents(battle, events)
+	}
+}
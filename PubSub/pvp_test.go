@@ -0,0 +1,97 @@
+package PubSub
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestPvPBattle(t *testing.T) *PvPBattle {
+	t.Helper()
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	b, err := NewPvPBattle("b1", "red", "blue", testParty(), testParty(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPvPIdleSideForfeits(t *testing.T) {
+	b := newTestPvPBattle(t)
+	var events []string
+	for turn := 1; turn <= maxPvPTimeouts; turn++ {
+		if b.over() {
+			t.Fatalf("battle ended after %d turns", turn-1)
+		}
+		if err := b.Choose("red", pvpAction{Move: 1}); err != nil {
+			t.Fatal(err)
+		}
+		events = b.ResolveTurn()
+	}
+	if b.Winner != "red" || b.Drawn {
+		t.Fatalf("winner = %q, drawn = %v, want red", b.Winner, b.Drawn)
+	}
+	want := []string{"BATTLE FORFEIT blue", "BATTLE WINNER red"}
+	if got := events[len(events)-2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("last events = %q, want %q", got, want)
+	}
+}
+
+func TestPvPTimeoutsResetWhenSideActs(t *testing.T) {
+	b := newTestPvPBattle(t)
+	for turn := 1; turn < maxPvPTimeouts; turn++ {
+		if err := b.Choose("blue", pvpAction{Move: 1}); err != nil {
+			t.Fatal(err)
+		}
+		b.ResolveTurn()
+	}
+	if err := b.Choose("red", pvpAction{Move: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Choose("blue", pvpAction{Move: 1}); err != nil {
+		t.Fatal(err)
+	}
+	b.ResolveTurn()
+	if b.Sides[0].Timeouts != 0 || b.Winner == "blue" {
+		t.Errorf("red timeouts = %d, winner = %q after red acted", b.Sides[0].Timeouts, b.Winner)
+	}
+}
+
+func TestPvPBothIdleDraws(t *testing.T) {
+	b := newTestPvPBattle(t)
+	var events []string
+	for turn := 1; turn <= maxPvPTimeouts; turn++ {
+		events = b.ResolveTurn()
+	}
+	if !b.Drawn || b.Winner != "" || events[len(events)-1] != "BATTLE DRAW" {
+		t.Errorf("drawn = %v, winner = %q, events = %q", b.Drawn, b.Winner, events)
+	}
+	if err := b.Choose("red", pvpAction{Move: 1}); err != errBattleOver {
+		t.Errorf("Choose after a draw error = %v, want %v", err, errBattleOver)
+	}
+}
+
+func TestChallengeRefusedDuringEncounter(t *testing.T) {
+	s := newTestServer(t)
+	ash, misty := &recordConn{}, &recordConn{}
+	s.clients["ash"], s.clients["misty"] = ash, misty
+
+	s.encounters["ash"] = &Encounter{}
+	s.Challenge("misty", misty, "ash")
+	if got := misty.lastLine(); got != "CHALLENGE ERROR player busy" {
+		t.Errorf("challenge during an encounter: %q", got)
+	}
+
+	delete(s.encounters, "ash")
+	s.Challenge("misty", misty, "ash")
+	if got := misty.lastLine(); got != "CHALLENGE SENT ash" {
+		t.Fatalf("challenge: %q", got)
+	}
+	s.encounters["ash"] = &Encounter{}
+	s.AnswerChallenge("ash", ash, true)
+	if got := ash.lastLine(); got != "CHALLENGE ERROR player busy" {
+		t.Errorf("accept during an encounter: %q", got)
+	}
+	if _, exists := s.pvpBattles["ash"]; exists {
+		t.Error("battle started during an encounter")
+	}
+}
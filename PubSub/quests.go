@@ -0,0 +1,217 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+const questsFile = "quests.json"
+
+// Game event types that quests can count.
+const (
+	EventMove      = "move"
+	EventCapture   = "capture"
+	EventBattleWon = "battle_won"
+	EventTrade     = "trade"
+)
+
+// GameEvent is something a player did that quests may count.
+type GameEvent struct {
+	Type      string
+	SpeciesID int
+}
+
+type QuestReward struct {
+	Items    map[string]int `json:"items,omitempty"`
+	Exp      int            `json:"exp,omitempty"`
+	Currency int            `json:"currency,omitempty"`
+}
+
+// Quest counts Target events of type Event. When Type is set only events
+// involving a species of that type count.
+type Quest struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Event       string      `json:"event"`
+	Type        string      `json:"type,omitempty"`
+	Target      int         `json:"target"`
+	Reward      QuestReward `json:"reward"`
+}
+
+type QuestList struct {
+	Quests []Quest `json:"quests"`
+}
+
+// QuestProgress is a player's state for one quest.
+type QuestProgress struct {
+	Progress  int  `json:"progress"`
+	Completed bool `json:"completed"`
+	Claimed   bool `json:"claimed"`
+}
+
+var quests []Quest
+
+func LoadQuests(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening quests file: %v", err)
+	}
+	defer file.Close()
+
+	var list QuestList
+	if err := json.NewDecoder(file).Decode(&list); err != nil {
+		return fmt.Errorf("error decoding quests file: %v", err)
+	}
+	quests = list.Quests
+	return nil
+}
+
+func decodeQuestProgress(v interface{}) map[string]QuestProgress {
+	progress := make(map[string]QuestProgress)
+	if existing, ok := v.(map[string]QuestProgress); ok {
+		for id, p := range existing {
+			progress[id] = p
+		}
+		return progress
+	}
+	if v == nil {
+		return progress
+	}
+	if data, err := json.Marshal(v); err == nil {
+		_ = json.Unmarshal(data, &progress)
+	}
+	return progress
+}
+
+func (q Quest) matches(event GameEvent) bool {
+	if q.Event != event.Type {
+		return false
+	}
+	if q.Type == "" {
+		return true
+	}
+	sp, ok := lookupSpecies(event.SpeciesID)
+	if !ok {
+		return false
+	}
+	for _, t := range sp.Types {
+		if t == q.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// emitGameEvent advances user's quests that count event and announces the
+// ones it completes. Caller must hold s.mutex and persist user.
+func (s *Server) emitGameEvent(user map[string]interface{}, event GameEvent) {
+	progress := decodeQuestProgress(user["quests"])
+	clientID, _ := user["uID"].(string)
+	s.leaderboards.recordGameEvent(clientID, event)
+
+	changed := false
+	for _, q := range quests {
+		p := progress[q.ID]
+		if p.Completed || !q.matches(event) {
+			continue
+		}
+		p.Progress++
+		if p.Progress >= q.Target {
+			p.Completed = true
+			message := fmt.Sprintf("ACHIEVEMENT %s QUEST %s", clientID, q.ID)
+			s.writeToClient(clientID, "QUEST COMPLETE "+q.ID)
+			s.publishLocked(achievementsChannel, message)
+		}
+		progress[q.ID] = p
+		changed = true
+	}
+	if changed {
+		user["quests"] = progress
+	}
+}
+
+// SendQuests writes every quest with the client's progress to conn.
+func (s *Server) SendQuests(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		_, _ = conn.Write([]byte("QUESTS ERROR " + err.Error() + "\n"))
+		return
+	}
+	progress := decodeQuestProgress(user["quests"])
+
+	type questStatus struct {
+		Quest
+		QuestProgress
+	}
+	list := make([]questStatus, 0, len(quests))
+	for _, q := range quests {
+		list = append(list, questStatus{q, progress[q.ID]})
+	}
+	data, _ := json.Marshal(list)
+	_, _ = conn.Write([]byte("QUESTS " + string(data) + "\n"))
+}
+
+// ClaimQuest grants the reward of a completed quest once.
+func (s *Server) ClaimQuest(clientID string, conn net.Conn, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.claimQuest(clientID, id); err != nil {
+		_, _ = conn.Write([]byte("QUEST ERROR " + err.Error() + "\n"))
+		return
+	}
+	_, _ = conn.Write([]byte("QUEST CLAIMED " + id + "\n"))
+}
+
+func (s *Server) claimQuest(clientID, id string) error {
+	var quest *Quest
+	for i := range quests {
+		if quests[i].ID == id {
+			quest = &quests[i]
+		}
+	}
+	if quest == nil {
+		return errors.New("unknown quest")
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		return err
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return errors.New("unknown player")
+	}
+	progress := decodeQuestProgress(user["quests"])
+	p := progress[id]
+	switch {
+	case !p.Completed:
+		return errors.New("quest not completed")
+	case p.Claimed:
+		return errors.New("already claimed")
+	}
+
+	if quest.Reward.Currency > 0 {
+		if _, err := adjustBalance(user, quest.Reward.Currency, "quest "+id); err != nil {
+			return err
+		}
+	}
+	for item, qty := range quest.Reward.Items {
+		giveItem(user, item, qty)
+	}
+	if quest.Reward.Exp > 0 {
+		s.awardExp(user, "", quest.Reward.Exp)
+	}
+
+	p.Claimed = true
+	progress[id] = p
+	user["quests"] = progress
+	return s.storeClientsData(A)
+}
@@ -0,0 +1,354 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	eventsChannel    = "events"
+	raidDuration     = 5 * time.Minute
+	raidInterval     = 15 * time.Minute
+	raidJoinRadius   = 5  // tiles from the boss within which players can join
+	raidLevel        = 40 // level of scheduled raid bosses
+	raidHPMultiplier = 8  // bosses are built to be fought by several players
+)
+
+var (
+	errNoRaid     = errors.New("no raid")
+	errRaidOver   = errors.New("raid is over")
+	errOutOfRaid  = errors.New("no Pokemon able to battle")
+	errRaidTooFar = errors.New("too far from raid")
+)
+
+type raidParticipant struct {
+	ClientID string     `json:"clientID"`
+	Party    []*Battler `json:"-"`
+	Active   int        `json:"-"`
+	Attacks  int        `json:"attacks"`
+	Damage   int        `json:"damage"`
+}
+
+func (p *raidParticipant) active() *Battler {
+	return p.Party[p.Active]
+}
+
+// Raid is a boss Pokemon that every player nearby can attack until it
+// faints or the window closes. Like Battle, all randomness comes from rng.
+type Raid struct {
+	ID           string                      `json:"id"`
+	Channel      string                      `json:"channel"`
+	Boss         *Battler                    `json:"boss"`
+	Position     Position                    `json:"position"`
+	Ends         time.Time                   `json:"ends"`
+	Participants map[string]*raidParticipant `json:"participants"`
+	Defeated     bool                        `json:"defeated"`
+	rng          *rand.Rand
+	timer        *time.Timer
+}
+
+func NewRaid(id string, boss Pokemon, position Position, ends time.Time, seed int64) *Raid {
+	r := &Raid{
+		ID:           id,
+		Channel:      "raid-" + id,
+		Boss:         newBattler(boss),
+		Position:     position,
+		Ends:         ends,
+		Participants: make(map[string]*raidParticipant),
+		rng:          rand.New(rand.NewSource(seed)),
+	}
+	r.Boss.Stats.HP *= raidHPMultiplier
+	r.Boss.HP = r.Boss.Stats.HP
+	return r
+}
+
+// Join adds clientID with party to the raid.
+func (r *Raid) Join(clientID string, party []Pokemon) error {
+	if r.Defeated {
+		return errRaidOver
+	}
+	if len(party) == 0 {
+		return errNoPokemon
+	}
+	p := &raidParticipant{ClientID: clientID}
+	for _, pokemon := range party {
+		p.Party = append(p.Party, newBattler(pokemon))
+	}
+	r.Participants[clientID] = p
+	return nil
+}
+
+// Attack has clientID's active Pokemon use move n (1-based) on the boss,
+// which strikes back at that Pokemon unless it fainted.
+func (r *Raid) Attack(clientID string, n int) ([]string, error) {
+	if r.Defeated {
+		return nil, errRaidOver
+	}
+	p, joined := r.Participants[clientID]
+	if !joined {
+		return nil, errNoRaid
+	}
+	if p.active().fainted() {
+		return nil, errOutOfRaid
+	}
+	if n < 1 || n > len(p.active().Moves) {
+		return nil, errInvalidMove
+	}
+
+	hp := r.Boss.HP
+	events := []string{attack(r.rng, p.active(), r.Boss, p.active().Moves[n-1], clientID)}
+	p.Attacks++
+	p.Damage += hp - r.Boss.HP
+	if r.Boss.fainted() {
+		r.Defeated = true
+		return append(events, "BATTLE FAINTED "+r.Boss.Pokemon.UID), nil
+	}
+
+	move := r.Boss.Moves[r.rng.Intn(len(r.Boss.Moves))]
+	events = append(events, attack(r.rng, r.Boss, p.active(), move, "BOSS"))
+	if !p.active().fainted() {
+		return events, nil
+	}
+	events = append(events, "BATTLE FAINTED "+p.active().Pokemon.UID)
+	for i, battler := range p.Party {
+		if !battler.fainted() {
+			p.Active = i
+			return append(events, fmt.Sprintf("BATTLE SENT %s %s", clientID, battler.Pokemon.UID)), nil
+		}
+	}
+	return append(events, "RAID OUT "+clientID), nil
+}
+
+// Rewards splits pool among the players who attacked, by damage dealt,
+// on top of participation each.
+func (r *Raid) Rewards(participation, pool int) map[string]int {
+	total := 0
+	for _, p := range r.Participants {
+		total += p.Damage
+	}
+	rewards := make(map[string]int)
+	for clientID, p := range r.Participants {
+		if p.Attacks == 0 {
+			continue
+		}
+		rewards[clientID] = participation
+		if total > 0 {
+			rewards[clientID] += pool * p.Damage / total
+		}
+	}
+	return rewards
+}
+
+// raidOf returns the raid clientID has joined, or nil. Caller must hold
+// s.mutex.
+func (s *Server) raidOf(clientID string) *Raid {
+	for _, raid := range s.raids {
+		if _, joined := raid.Participants[clientID]; joined {
+			return raid
+		}
+	}
+	return nil
+}
+
+// startRaidSchedule spawns a raid boss of a random species every tick.
+func (s *Server) startRaidSchedule() {
+	for s.tick(s.raidTicker) {
+		if _, err := s.StartRaid(randomSpeciesID(), raidLevel); err != nil {
+			fmt.Printf("Error starting raid: %v\n", err)
+		}
+	}
+}
+
+// StartRaid spawns a boss of species id at a random location for
+// raidDuration and announces it on the events channel.
+func (s *Server) StartRaid(id, level int) (*Raid, error) {
+	if len(speciesCatalog) > 0 {
+		if _, ok := lookupSpecies(id); !ok {
+			return nil, fmt.Errorf("unknown species %d", id)
+		}
+	}
+	if level < 1 || level > maxLevel {
+		return nil, fmt.Errorf("invalid level %d", level)
+	}
+
+	boss := Pokemon{UID: uuid.New().String(), ID: id, EV: 1, LV: level}
+	boss.Exp = expForLevel(growthRateOf(id), level)
+	position := Position{X: rand.Intn(mapSize), Y: rand.Intn(mapSize)}
+	raid := NewRaid(uuid.New().String()[:8], boss, position, time.Now().Add(raidDuration), time.Now().UnixNano())
+
+	s.mutex.Lock()
+	s.raids[raid.ID] = raid
+	raid.timer = time.AfterFunc(raidDuration, func() {
+		s.endRaid(raid)
+	})
+	data, _ := json.Marshal(raid)
+	s.mutex.Unlock()
+
+	s.PublishMessage(eventsChannel, "RAID STARTED "+string(data))
+	return raid, nil
+}
+
+// SendRaids writes every open raid to conn.
+func (s *Server) SendRaids(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	list := make([]*Raid, 0, len(s.raids))
+	for _, raid := range s.raids {
+		list = append(list, raid)
+	}
+	data, _ := json.Marshal(list)
+	_, _ = conn.Write([]byte("RAIDS " + string(data) + "\n"))
+}
+
+// JoinRaid enters the client into raid id if they are close enough and
+// subscribes them to the raid's channel.
+func (s *Server) JoinRaid(clientID string, conn net.Conn, id string) {
+	raid, err := s.joinRaid(clientID, id)
+	if err != nil {
+		_, _ = conn.Write([]byte("RAID ERROR " + err.Error() + "\n"))
+		return
+	}
+	if err := s.AddSubscriber(raid.Channel, conn); err != nil {
+		s.mutex.Lock()
+		delete(raid.Participants, clientID)
+		s.mutex.Unlock()
+		_, _ = conn.Write([]byte("RAID ERROR " + err.Error() + "\n"))
+		return
+	}
+	s.PublishMessage(raid.Channel, fmt.Sprintf("RAID JOINED %s %s", raid.ID, clientID))
+}
+
+func (s *Server) joinRaid(clientID, id string) (*Raid, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	raid, exists := s.raids[id]
+	if !exists {
+		return nil, errNoRaid
+	}
+	if s.inBattle(clientID) {
+		return nil, errors.New("player busy")
+	}
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if distance(userPosition(user), raid.Position) > raidJoinRadius {
+		return nil, errRaidTooFar
+	}
+	if err := raid.Join(clientID, decodeListPokemon(user["listPokemon"])); err != nil {
+		return nil, err
+	}
+	return raid, nil
+}
+
+// RaidAttack runs RAID ATTACK <n> for the client and ends the raid when
+// the boss faints.
+func (s *Server) RaidAttack(clientID string, conn net.Conn, nText string) {
+	n, err := strconv.Atoi(nText)
+	if err != nil {
+		_, _ = conn.Write([]byte("Usage: RAID ATTACK <n>\n"))
+		return
+	}
+
+	s.mutex.Lock()
+	raid := s.raidOf(clientID)
+	var events []string
+	if raid == nil {
+		err = errNoRaid
+	} else {
+		events, err = raid.Attack(clientID, n)
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		_, _ = conn.Write([]byte("RAID ERROR " + err.Error() + "\n"))
+		return
+	}
+	for _, event := range events {
+		s.PublishMessage(raid.Channel, event)
+	}
+	if raid.Defeated {
+		s.endRaid(raid)
+	}
+}
+
+// LeaveRaid removes clientID from their raid, e.g. when they disconnect.
+// They keep no claim to its rewards.
+func (s *Server) LeaveRaid(clientID string) {
+	s.mutex.Lock()
+	raid := s.raidOf(clientID)
+	var conn net.Conn
+	if raid != nil {
+		delete(raid.Participants, clientID)
+		conn = s.clients[clientID]
+	}
+	s.mutex.Unlock()
+
+	if raid == nil {
+		return
+	}
+	if conn != nil {
+		s.RemoveSubscriber(raid.Channel, conn)
+	}
+	s.PublishMessage(raid.Channel, fmt.Sprintf("RAID LEFT %s %s", raid.ID, clientID))
+}
+
+// endRaid closes raid once, paying out its participants if the boss was
+// defeated, and announces the outcome on the events channel.
+func (s *Server) endRaid(raid *Raid) {
+	s.mutex.Lock()
+	if _, open := s.raids[raid.ID]; !open {
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.raids, raid.ID)
+	raid.timer.Stop()
+
+	var rewards map[string]int
+	if raid.Defeated {
+		rewards = raid.Rewards(raidParticipationReward, raidRewardPool)
+		s.payRaidRewards(raid, rewards)
+	}
+	s.mutex.Unlock()
+
+	result := "ESCAPED"
+	if raid.Defeated {
+		result = "DEFEATED"
+	}
+	s.PublishMessage(eventsChannel, fmt.Sprintf("RAID ENDED %s %s", raid.ID, result))
+	for clientID, amount := range rewards {
+		s.PublishMessage(eventsChannel, fmt.Sprintf("RAID REWARD %s %s %d", raid.ID, clientID, amount))
+	}
+	s.DeleteChannel(raid.Channel)
+}
+
+// payRaidRewards credits rewards and gives each rewarded player's active
+// Pokemon the boss's EXP. Caller must hold s.mutex.
+func (s *Server) payRaidRewards(raid *Raid, rewards map[string]int) {
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	for clientID, amount := range rewards {
+		user := findUser(A, clientID)
+		if user == nil {
+			continue
+		}
+		s.reward(user, amount, "raid "+raid.ID)
+		s.awardExp(user, raid.Participants[clientID].active().Pokemon.UID, expYield(raid.Boss.Pokemon))
+		s.emitGameEvent(user, GameEvent{Type: EventBattleWon, SpeciesID: raid.Boss.Pokemon.ID})
+	}
+	if err := s.storeClientsData(A); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
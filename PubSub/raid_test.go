@@ -0,0 +1,124 @@
+package PubSub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJoinRaidUndoneWhenSubscribeFails(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	s := newTestServer(t)
+	conn := addTestPlayer(t, s, "ash", Position{X: 10, Y: 10}, testParty())
+	raid := NewRaid("r1", Pokemon{UID: "boss", ID: 1, LV: 30}, Position{X: 10, Y: 10}, time.Now().Add(time.Minute), 1)
+	s.raids[raid.ID] = raid
+	s.acls[raid.Channel] = newChannelACL(serverOwner, ModePrivate)
+
+	s.JoinRaid("ash", conn, raid.ID)
+	if got := conn.lastLine(); got != "RAID ERROR "+errNotAllowed.Error() {
+		t.Errorf("reply = %q", got)
+	}
+	if _, joined := raid.Participants["ash"]; joined {
+		t.Error("player stayed in the raid without its channel")
+	}
+
+	delete(s.acls, raid.Channel)
+	s.JoinRaid("ash", conn, raid.ID)
+	if _, joined := raid.Participants["ash"]; !joined || !s.channels[raid.Channel][conn] {
+		t.Errorf("join failed: %q", conn.lines())
+	}
+}
+
+func TestRaidRewards(t *testing.T) {
+	tests := []struct {
+		name         string
+		participants map[string]*raidParticipant
+		want         map[string]int
+	}{
+		{
+			name:         "no one joined",
+			participants: map[string]*raidParticipant{},
+			want:         map[string]int{},
+		},
+		{
+			name: "split by damage",
+			participants: map[string]*raidParticipant{
+				"ash":   {Attacks: 3, Damage: 300},
+				"misty": {Attacks: 1, Damage: 100},
+			},
+			want: map[string]int{"ash": 50 + 750, "misty": 50 + 250},
+		},
+		{
+			name: "rounded down",
+			participants: map[string]*raidParticipant{
+				"ash":   {Attacks: 1, Damage: 1},
+				"misty": {Attacks: 1, Damage: 1},
+				"brock": {Attacks: 1, Damage: 1},
+			},
+			want: map[string]int{"ash": 50 + 333, "misty": 50 + 333, "brock": 50 + 333},
+		},
+		{
+			name: "joined without attacking",
+			participants: map[string]*raidParticipant{
+				"ash":   {Attacks: 2, Damage: 80},
+				"misty": {},
+			},
+			want: map[string]int{"ash": 50 + 1000},
+		},
+		{
+			name: "attacked without damage",
+			participants: map[string]*raidParticipant{
+				"ash":   {Attacks: 2},
+				"misty": {Attacks: 1},
+			},
+			want: map[string]int{"ash": 50, "misty": 50},
+		},
+	}
+	for _, tt := range tests {
+		r := &Raid{Participants: tt.participants}
+		got := r.Rewards(50, 1000)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: rewards = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for clientID, amount := range tt.want {
+			if got[clientID] != amount {
+				t.Errorf("%s: rewards = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRaidDamageAddsUpToBossHP(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	raid := NewRaid("r1", Pokemon{UID: "boss", ID: 1, LV: 5}, Position{}, time.Now().Add(time.Minute), 1)
+	players := []string{"ash", "misty"}
+	for _, clientID := range players {
+		if err := raid.Join(clientID, []Pokemon{{UID: clientID + "1", ID: 4, LV: 50}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for turn := 0; !raid.Defeated; turn++ {
+		if turn > 200 {
+			t.Fatal("boss never fainted")
+		}
+		if _, err := raid.Attack(players[turn%2], 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total := 0
+	for _, p := range raid.Participants {
+		total += p.Damage
+	}
+	if total != raid.Boss.Stats.HP {
+		t.Errorf("damage dealt adds up to %d, want the boss's %d HP", total, raid.Boss.Stats.HP)
+	}
+	if _, err := raid.Attack("ash", 1); err != errRaidOver {
+		t.Errorf("attack after the boss fainted: err = %v, want %v", err, errRaidOver)
+	}
+	if _, err := (&Raid{Participants: map[string]*raidParticipant{}}).Attack("brock", 1); err != errNoRaid {
+		t.Errorf("attack without joining: err = %v, want %v", err, errNoRaid)
+	}
+}
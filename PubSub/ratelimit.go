@@ -0,0 +1,282 @@
+package PubSub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxLineSize = 4096 // longest command line a client may send
+
+	connectionRate  = 10 // commands per second on one connection
+	connectionBurst = 30
+	accountRate     = 5 // commands per second for one player, across reconnects
+	accountBurst    = 20
+	publishRate     = 1 // PUBLISH, WHISPER and SAY lines per second for one player
+	publishBurst    = 5
+
+	strikeWindow      = time.Minute // strikes reset after this long without one
+	muteStrikes       = 10          // limited commands before publishing is muted
+	kickStrikes       = 30          // limited commands before disconnecting
+	floodMuteDuration = time.Minute
+
+	loginFailureWindow      = 15 * time.Minute // failed logins are forgotten after this long
+	maxAccountLoginFailures = 5                // failed logins for one username before it is locked
+	maxAddressLoginFailures = 20               // failed logins from one address before it is locked
+)
+
+// Rate limit verdicts for one command.
+const (
+	limitOK = iota
+	limitDropped
+	limitMuted // the player is muted and the command is chat
+	limitMutedNow
+	limitKicked
+)
+
+// tokenBucket allows rate commands per second with bursts of up to burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{tokens: burst, last: time.Now(), rate: rate, burst: burst}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// accountLimits is one player's buckets, strikes and counters.
+type accountLimits struct {
+	commands   *tokenBucket
+	publishes  *tokenBucket
+	strikes    int
+	lastStrike time.Time
+	mutedUntil time.Time
+
+	Commands int
+	Limited  int
+	Mutes    int
+	Kicks    int
+}
+
+// RateLimits tracks every player's command rate. It has its own lock so
+// checking a command never waits on s.mutex.
+type RateLimits struct {
+	mutex    sync.Mutex
+	accounts map[string]*accountLimits
+}
+
+func NewRateLimits() *RateLimits {
+	return &RateLimits{accounts: make(map[string]*accountLimits)}
+}
+
+func (l *RateLimits) account(clientID string) *accountLimits {
+	a, exists := l.accounts[clientID]
+	if !exists {
+		a = &accountLimits{
+			commands:  newTokenBucket(accountRate, accountBurst),
+			publishes: newTokenBucket(publishRate, publishBurst),
+		}
+		l.accounts[clientID] = a
+	}
+	return a
+}
+
+// Check charges command to the connection's bucket and clientID's buckets
+// and returns the verdict, with how long a mute still lasts.
+func (l *RateLimits) Check(clientID string, connection *tokenBucket, command string) (int, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	a := l.account(clientID)
+	a.Commands++
+	now := time.Now()
+
+	allowed := connection.allow(now) && a.commands.allow(now)
+	if allowed && (command == "PUBLISH" || command == "WHISPER" || command == "SAY") {
+		if now.Before(a.mutedUntil) {
+			return limitMuted, a.mutedUntil.Sub(now)
+		}
+		allowed = a.publishes.allow(now)
+	}
+	if allowed {
+		return limitOK, 0
+	}
+
+	a.Limited++
+	if now.Sub(a.lastStrike) > strikeWindow {
+		a.strikes = 0
+	}
+	a.strikes++
+	a.lastStrike = now
+	switch {
+	case a.strikes >= kickStrikes:
+		a.Kicks++
+		a.strikes = 0
+		return limitKicked, 0
+	case a.strikes == muteStrikes:
+		a.Mutes++
+		a.mutedUntil = now.Add(floodMuteDuration)
+		return limitMutedNow, floodMuteDuration
+	}
+	return limitDropped, 0
+}
+
+// loginFailures counts failed logins for one username or address since
+// first.
+type loginFailures struct {
+	count int
+	first time.Time
+}
+
+// LoginLimits locks usernames and addresses that fail to log in too often,
+// so a guesser gains nothing by reconnecting. It has its own lock like
+// RateLimits.
+type LoginLimits struct {
+	mutex    sync.Mutex
+	failures map[string]*loginFailures // "user:<name>" or "addr:<ip>"
+}
+
+func NewLoginLimits() *LoginLimits {
+	return &LoginLimits{failures: make(map[string]*loginFailures)}
+}
+
+func loginAccountKey(username string) string { return "user:" + strings.ToLower(username) }
+func loginAddressKey(address string) string  { return "addr:" + address }
+
+// current returns key's failures in the current window, or nil.
+func (l *LoginLimits) current(key string, now time.Time) *loginFailures {
+	f, exists := l.failures[key]
+	if !exists {
+		return nil
+	}
+	if now.Sub(f.first) >= loginFailureWindow {
+		delete(l.failures, key)
+		return nil
+	}
+	return f
+}
+
+// Locked returns how long logins for username or from address stay
+// refused, or 0 when they are allowed.
+func (l *LoginLimits) Locked(username, address string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for key, max := range map[string]int{
+		loginAccountKey(username): maxAccountLoginFailures,
+		loginAddressKey(address):  maxAddressLoginFailures,
+	} {
+		if f := l.current(key, now); f != nil && f.count >= max {
+			if left := f.first.Add(loginFailureWindow).Sub(now); left > wait {
+				wait = left
+			}
+		}
+	}
+	return wait
+}
+
+// Fail records a failed login for username from address.
+func (l *LoginLimits) Fail(username, address string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for _, key := range []string{loginAccountKey(username), loginAddressKey(address)} {
+		f := l.current(key, now)
+		if f == nil {
+			f = &loginFailures{first: now}
+			l.failures[key] = f
+		}
+		f.count++
+	}
+}
+
+// Succeed forgets username's failures. The address keeps its count so one
+// known password cannot clear the way for guessing others.
+func (l *LoginLimits) Succeed(username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, loginAccountKey(username))
+}
+
+// Mute stops clientID publishing for d.
+func (l *RateLimits) Mute(clientID string, d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	a := l.account(clientID)
+	a.Mutes++
+	a.mutedUntil = time.Now().Add(d)
+}
+
+// allowCommand checks command for clientID and tells them when it is
+// refused. It returns false when the command must be skipped and, as its
+// second result, true when the connection must be closed.
+func (s *Server) allowCommand(clientID string, connection *tokenBucket, command string) (bool, bool) {
+	verdict, muted := s.limits.Check(clientID, connection, command)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch verdict {
+	case limitDropped:
+		s.writeToClient(clientID, "RATE LIMITED")
+	case limitMuted:
+		s.writeToClient(clientID, fmt.Sprintf("MUTED %d", int(muted.Seconds())+1))
+	case limitMutedNow:
+		s.writeToClient(clientID, fmt.Sprintf("RATE LIMITED MUTED %d", int(muted.Seconds())))
+		fmt.Printf("Muted %s for flooding\n", clientID)
+	case limitKicked:
+		s.writeToClient(clientID, "RATE LIMITED DISCONNECTED")
+		fmt.Printf("Disconnected %s for flooding\n", clientID)
+		return false, true
+	}
+	return verdict == limitOK, false
+}
+
+// ShowLimitsInConsole prints the rate limit counters of every player who
+// sent a command, or of clientID only.
+func (s *Server) ShowLimitsInConsole(clientID string) {
+	s.limits.mutex.Lock()
+	defer s.limits.mutex.Unlock()
+
+	ids := make([]string, 0, len(s.limits.accounts))
+	for id := range s.limits.accounts {
+		if clientID == "" || id == clientID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		fmt.Println("No rate limit counters")
+		return
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	for _, id := range ids {
+		a := s.limits.accounts[id]
+		muted := ""
+		if now.Before(a.mutedUntil) {
+			muted = fmt.Sprintf(" muted for %ds", int(a.mutedUntil.Sub(now).Seconds())+1)
+		}
+		fmt.Printf("%s: commands=%d limited=%d mutes=%d kicks=%d%s\n", id, a.Commands, a.Limited, a.Mutes, a.Kicks, muted)
+	}
+}
@@ -0,0 +1,99 @@
+package PubSub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		after []time.Duration // when each command comes, from start
+		want  []bool
+	}{
+		{"burst", []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refills at rate", []time.Duration{0, 0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond}, []bool{true, true, true, false, true, false}},
+		{"refill capped at burst", []time.Duration{time.Hour, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, false}},
+		{"steady at rate", []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 3 * time.Second}, []bool{true, true, true, true, true, true}},
+	}
+	for _, tt := range tests {
+		b := &tokenBucket{tokens: 3, last: start, rate: 2, burst: 3}
+		for i, after := range tt.after {
+			if got := b.allow(start.Add(after)); got != tt.want[i] {
+				t.Errorf("%s: command %d allowed = %v, want %v", tt.name, i+1, got, tt.want[i])
+			}
+		}
+	}
+}
+
+// emptyBucket is a connection that is always over its limit.
+func emptyBucket() *tokenBucket {
+	return &tokenBucket{last: time.Now()}
+}
+
+func TestRateLimitsStrikes(t *testing.T) {
+	l := NewRateLimits()
+	for strike := 1; strike <= kickStrikes; strike++ {
+		want := limitDropped
+		switch strike {
+		case muteStrikes:
+			want = limitMutedNow
+		case kickStrikes:
+			want = limitKicked
+		}
+		verdict, muted := l.Check("ash", emptyBucket(), "MOVE")
+		if verdict != want {
+			t.Fatalf("strike %d: verdict = %d, want %d", strike, verdict, want)
+		}
+		if want == limitMutedNow && muted != floodMuteDuration {
+			t.Errorf("muted for %v, want %v", muted, floodMuteDuration)
+		}
+	}
+
+	// Muted players may still play but not chat.
+	connection := newTokenBucket(connectionRate, connectionBurst)
+	for _, tt := range []struct {
+		command string
+		want    int
+	}{
+		{"MOVE", limitOK},
+		{"PUBLISH", limitMuted},
+		{"WHISPER", limitMuted},
+		{"SAY", limitMuted},
+	} {
+		if verdict, muted := l.Check("ash", connection, tt.command); verdict != tt.want || (tt.want == limitMuted && muted <= 0) {
+			t.Errorf("%s while muted: verdict = %d for %v, want %d", tt.command, verdict, muted, tt.want)
+		}
+	}
+	if a := l.accounts["ash"]; a.Limited != kickStrikes || a.Mutes != 1 || a.Kicks != 1 {
+		t.Errorf("counters: limited=%d mutes=%d kicks=%d", a.Limited, a.Mutes, a.Kicks)
+	}
+}
+
+func TestRateLimitsBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		burst   int
+	}{
+		{"commands", "MOVE", accountBurst},
+		{"chat", "PUBLISH", publishBurst},
+		{"whispers", "WHISPER", publishBurst},
+	}
+	for _, tt := range tests {
+		l := NewRateLimits()
+		// Each command comes on a new connection, as if reconnecting.
+		for i := 0; i < tt.burst; i++ {
+			if verdict, _ := l.Check("ash", newTokenBucket(connectionRate, connectionBurst), tt.command); verdict != limitOK {
+				t.Fatalf("%s: command %d verdict = %d", tt.name, i+1, verdict)
+			}
+		}
+		if verdict, _ := l.Check("ash", newTokenBucket(connectionRate, connectionBurst), tt.command); verdict != limitDropped {
+			t.Errorf("%s: command over the burst: verdict = %d, want %d", tt.name, verdict, limitDropped)
+		}
+		if verdict, _ := l.Check("misty", newTokenBucket(connectionRate, connectionBurst), tt.command); verdict != limitOK {
+			t.Errorf("%s: another player was limited: verdict = %d", tt.name, verdict)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+var errUnknownResource = errors.New("unknown resource")
+
+// resource builds a server-side view for GET. Caller must hold s.mutex.
+type resource func(s *Server, args []string) (interface{}, error)
+
+// resources is the allowlist of what GET serves; nothing else on disk is
+// reachable from a client.
+var resources = map[string]resource{
+	"clients": func(s *Server, args []string) (interface{}, error) {
+		return s.publicPlayers()
+	},
+	"world": func(s *Server, args []string) (interface{}, error) {
+		return loadPokemonWorld()
+	},
+	"species": func(s *Server, args []string) (interface{}, error) {
+		if len(args) < 1 {
+			return nil, errors.New("usage: GET species <id>")
+		}
+		return speciesView(args[0])
+	},
+	"items": func(s *Server, args []string) (interface{}, error) {
+		list := make([]Item, 0, len(itemIDs))
+		for _, id := range itemIDs {
+			list = append(list, itemCatalog[id])
+		}
+		return list, nil
+	},
+}
+
+// PublicPokemon is what other players see of a party member.
+type PublicPokemon struct {
+	ID int `json:"id"`
+	LV int `json:"lv"`
+}
+
+// PublicPlayer is what other players see of a player: no address,
+// balance, items or other private state.
+type PublicPlayer struct {
+	UID       string          `json:"uID"`
+	Position  Position        `json:"position"`
+	Direction int             `json:"direction"`
+	Party     []PublicPokemon `json:"party"`
+}
+
+// publicPlayers projects clients.json onto PublicPlayer. Caller must hold
+// s.mutex.
+func (s *Server) publicPlayers() ([]PublicPlayer, error) {
+	A, err := s.loadClientsData()
+	if err != nil {
+		return nil, err
+	}
+	users, _ := A["user"].([]interface{})
+	players := make([]PublicPlayer, 0, len(users))
+	for _, u := range users {
+		user, ok := u.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		uID, _ := user["uID"].(string)
+		player := PublicPlayer{
+			UID:       uID,
+			Position:  userPosition(user),
+			Direction: userCounter(user, "direction"),
+			Party:     []PublicPokemon{},
+		}
+		for _, p := range decodeListPokemon(user["listPokemon"]) {
+			player.Party = append(player.Party, PublicPokemon{ID: p.ID, LV: p.LV})
+		}
+		players = append(players, player)
+	}
+	return players, nil
+}
+
+func resourceNames() []string {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SendResource writes the named resource to conn only, as
+// RESOURCE <name> <json>.
+func (s *Server) SendResource(conn net.Conn, name string, args []string) {
+	build, ok := resources[name]
+	if !ok {
+		_, _ = conn.Write([]byte("RESOURCE ERROR " + name + " " + errUnknownResource.Error() +
+			"; available: " + strings.Join(resourceNames(), ", ") + "\n"))
+		return
+	}
+
+	s.mutex.Lock()
+	view, err := build(s, args)
+	s.mutex.Unlock()
+	if err != nil {
+		_, _ = conn.Write([]byte("RESOURCE ERROR " + name + " " + err.Error() + "\n"))
+		return
+	}
+	data, err := json.Marshal(view)
+	if err != nil {
+		fmt.Printf("Error marshalling resource %s: %v\n", name, err)
+		return
+	}
+	_, _ = conn.Write([]byte("RESOURCE " + name + " " + string(data) + "\n"))
+}
@@ -0,0 +1,55 @@
+package PubSub
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	DefaultSayRadius = 8     // tiles a SAY carries unless configured otherwise
+	sayChannel       = "say" // for MUTE <player> say
+)
+
+// SetSayRadius sets how many tiles around the speaker SAY reaches.
+func (s *Server) SetSayRadius(radius int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sayRadius = radius
+}
+
+// Say delivers message to every online player within sayRadius of
+// clientID's position at the moment it is sent, the speaker included, as
+// SAY <name> <x> <y> <message>.
+func (s *Server) Say(clientID string, conn net.Conn, message string) {
+	if s.moderation.Muted(clientID, sayChannel) {
+		_, _ = conn.Write([]byte("SAY ERROR " + errMuted.Error() + "\n"))
+		return
+	}
+	_, name, err := s.resolvePlayer(clientID)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	message = s.moderation.Filter(message)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	speaker := findUser(A, clientID)
+	if speaker == nil {
+		return
+	}
+	pos := userPosition(speaker)
+
+	line := fmt.Sprintf("SAY %s %d %d %s", name, pos.X, pos.Y, message)
+	for id := range s.clients {
+		user := findUser(A, id)
+		if user != nil && distance(pos, userPosition(user)) <= s.sayRadius {
+			s.writeToClient(id, line)
+		}
+	}
+}
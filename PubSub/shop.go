@@ -0,0 +1,160 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	shopsFile  = "shops.json"
+	shopRadius = 2  // tiles from the shop within which a player can trade
+	maxBuyQty  = 99 // most of one item a player can buy at once
+)
+
+type ShopItem struct {
+	Item  string `json:"item"`
+	Price int    `json:"price"`
+}
+
+type Shop struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Position Position   `json:"position"`
+	Stock    []ShopItem `json:"stock"`
+}
+
+type ShopList struct {
+	Shops []Shop `json:"shops"`
+}
+
+var shops []Shop
+
+func LoadShops(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening shops file: %v", err)
+	}
+	defer file.Close()
+
+	var list ShopList
+	if err := json.NewDecoder(file).Decode(&list); err != nil {
+		return fmt.Errorf("error decoding shops file: %v", err)
+	}
+	shops = list.Shops
+	return nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// distance is the number of king moves between two tiles.
+func distance(a, b Position) int {
+	dx, dy := abs(a.X-b.X), abs(a.Y-b.Y)
+	if dx > dy {
+		return dx
+	}
+	return dy
+}
+
+func userPosition(user map[string]interface{}) Position {
+	return Position{X: userCounter(user, "positionX"), Y: userCounter(user, "positionY")}
+}
+
+// nearestShop returns the closest shop to pos and whether it is in reach.
+func nearestShop(pos Position) (*Shop, bool) {
+	var nearest *Shop
+	for i := range shops {
+		if nearest == nil || distance(pos, shops[i].Position) < distance(pos, nearest.Position) {
+			nearest = &shops[i]
+		}
+	}
+	if nearest == nil {
+		return nil, false
+	}
+	return nearest, distance(pos, nearest.Position) <= shopRadius
+}
+
+// SendShopList writes the stock of the shop the client is standing at, or
+// where the nearest shop is.
+func (s *Server) SendShopList(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		_, _ = conn.Write([]byte("SHOP ERROR " + err.Error() + "\n"))
+		return
+	}
+	shop, inReach := nearestShop(userPosition(user))
+	if shop == nil {
+		_, _ = conn.Write([]byte("NO SHOP\n"))
+		return
+	}
+	if !inReach {
+		_, _ = conn.Write([]byte(fmt.Sprintf("NO SHOP NEARBY %s %d %d\n", shop.ID, shop.Position.X, shop.Position.Y)))
+		return
+	}
+	data, _ := json.Marshal(shop)
+	_, _ = conn.Write([]byte("SHOP " + string(data) + "\n"))
+}
+
+// Buy purchases qty of item from the shop in reach of the client.
+func (s *Server) Buy(clientID string, conn net.Conn, item, qtyText string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	balance, err := s.buy(clientID, item, qtyText)
+	if err != nil {
+		_, _ = conn.Write([]byte("BUY ERROR " + err.Error() + "\n"))
+		return
+	}
+	_, _ = conn.Write([]byte(fmt.Sprintf("BOUGHT %s %s %d\n", item, qtyText, balance)))
+}
+
+func (s *Server) buy(clientID, item, qtyText string) (int, error) {
+	qty, err := strconv.Atoi(qtyText)
+	if err != nil || qty < 1 || qty > maxBuyQty {
+		return 0, fmt.Errorf("quantity must be 1-%d", maxBuyQty)
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		return 0, err
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return 0, errors.New("unknown player")
+	}
+
+	shop, inReach := nearestShop(userPosition(user))
+	if !inReach {
+		return 0, errors.New("no shop nearby")
+	}
+	price := -1
+	for _, stock := range shop.Stock {
+		if stock.Item == item {
+			price = stock.Price
+		}
+	}
+	if price < 0 {
+		return 0, errors.New("not sold here")
+	}
+	if price > userCounter(user, "balance")/qty {
+		return 0, errInsufficientFunds
+	}
+
+	entry, err := adjustBalance(user, -price*qty, fmt.Sprintf("buy %s x%d at %s", item, qty, shop.ID))
+	if err != nil {
+		return 0, err
+	}
+	giveItem(user, item, qty)
+	return entry.Balance, s.storeClientsData(A)
+}
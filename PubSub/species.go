@@ -0,0 +1,127 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const speciesFile = "species.json"
+
+type BaseStats struct {
+	HP        int `json:"hp"`
+	Attack    int `json:"attack"`
+	Defense   int `json:"defense"`
+	SpAttack  int `json:"spAttack"`
+	SpDefense int `json:"spDefense"`
+	Speed     int `json:"speed"`
+}
+
+// Evolution describes one way a species evolves: by reaching Level, by
+// using Item on it, or by being traded.
+type Evolution struct {
+	ID    int    `json:"id"`
+	Level int    `json:"level,omitempty"`
+	Item  string `json:"item,omitempty"`
+	Trade bool   `json:"trade,omitempty"`
+}
+
+type Species struct {
+	ID          int         `json:"id"`
+	Name        string      `json:"name"`
+	Types       []string    `json:"types"`
+	BaseStats   BaseStats   `json:"baseStats"`
+	GrowthRate  string      `json:"growthRate"`
+	CatchRate   int         `json:"catchRate"`
+	EvolvesFrom int         `json:"evolvesFrom,omitempty"`
+	EvolvesTo   []Evolution `json:"evolvesTo,omitempty"`
+}
+
+type SpeciesCatalog struct {
+	Species []Species `json:"species"`
+}
+
+var speciesCatalog = map[int]Species{}
+
+// speciesIDs lists the catalog keys in ascending order for spawning.
+var speciesIDs []int
+
+func LoadSpeciesCatalog(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening species file: %v", err)
+	}
+	defer file.Close()
+
+	var catalog SpeciesCatalog
+	if err := json.NewDecoder(file).Decode(&catalog); err != nil {
+		return fmt.Errorf("error decoding species file: %v", err)
+	}
+
+	speciesCatalog = make(map[int]Species, len(catalog.Species))
+	speciesIDs = speciesIDs[:0]
+	for _, sp := range catalog.Species {
+		speciesCatalog[sp.ID] = sp
+		speciesIDs = append(speciesIDs, sp.ID)
+	}
+	sort.Ints(speciesIDs)
+	return nil
+}
+
+func lookupSpecies(id int) (Species, bool) {
+	sp, ok := speciesCatalog[id]
+	return sp, ok
+}
+
+// randomSpeciesID picks a species from the catalog, falling back to the
+// full national range when no catalog is loaded.
+func randomSpeciesID() int {
+	if len(speciesIDs) == 0 {
+		return rand.Intn(898) + 1 // Random ID between 1 and 898
+	}
+	return speciesIDs[rand.Intn(len(speciesIDs))]
+}
+
+// evolutionChain returns every species ID in id's family, starting from
+// the base form.
+func evolutionChain(id int) []int {
+	base := id
+	for {
+		sp, ok := speciesCatalog[base]
+		if !ok || sp.EvolvesFrom == 0 {
+			break
+		}
+		base = sp.EvolvesFrom
+	}
+
+	var chain []int
+	queue := []int{base}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		chain = append(chain, current)
+		for _, evo := range speciesCatalog[current].EvolvesTo {
+			queue = append(queue, evo.ID)
+		}
+	}
+	return chain
+}
+
+// speciesView is the catalog entry for idText with its evolution chain.
+func speciesView(idText string) (interface{}, error) {
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid species id %s", idText)
+	}
+	sp, ok := lookupSpecies(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown species %s", idText)
+	}
+	return struct {
+		Species
+		Chain []int `json:"chain"`
+	}{sp, evolutionChain(id)}, nil
+}
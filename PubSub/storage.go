@@ -0,0 +1,251 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	partySize   = 6
+	boxCount    = 8
+	boxCapacity = 30
+)
+
+var errStorageFull = errors.New("storage full")
+
+func emptyBoxes() [][]Pokemon {
+	boxes := make([][]Pokemon, boxCount)
+	for i := range boxes {
+		boxes[i] = []Pokemon{}
+	}
+	return boxes
+}
+
+func decodeBoxes(v interface{}) [][]Pokemon {
+	boxes := emptyBoxes()
+	raw, ok := v.([]interface{})
+	if !ok {
+		return boxes
+	}
+	for i := 0; i < len(raw) && i < boxCount; i++ {
+		boxes[i] = decodeListPokemon(raw[i])
+		if boxes[i] == nil {
+			boxes[i] = []Pokemon{}
+		}
+	}
+	return boxes
+}
+
+func storedCount(party []Pokemon, boxes [][]Pokemon) int {
+	count := len(party)
+	for _, box := range boxes {
+		count += len(box)
+	}
+	return count
+}
+
+// setStorage writes party and boxes back to user. A user's listPokemon is
+// their active party and everything else lives in "boxes"; maxValue and
+// spaceLeft report total capacity and free slots.
+func setStorage(user map[string]interface{}, party []Pokemon, boxes [][]Pokemon) {
+	if party == nil {
+		party = []Pokemon{}
+	}
+	user["listPokemon"] = party
+	user["boxes"] = boxes
+	user["maxValue"] = partySize + boxCount*boxCapacity
+	user["spaceLeft"] = partySize + boxCount*boxCapacity - storedCount(party, boxes)
+}
+
+func newUserStorage(user map[string]interface{}, party []Pokemon) {
+	setStorage(user, party, emptyBoxes())
+}
+
+// addToCollection places p in the party, or the first box with room. It
+// returns where p went, or errStorageFull.
+func addToCollection(user map[string]interface{}, p Pokemon) (string, error) {
+	party := decodeListPokemon(user["listPokemon"])
+	boxes := decodeBoxes(user["boxes"])
+	if len(party) < partySize {
+		setStorage(user, append(party, p), boxes)
+		return "PARTY", nil
+	}
+	for i := range boxes {
+		if len(boxes[i]) < boxCapacity {
+			boxes[i] = append(boxes[i], p)
+			setStorage(user, party, boxes)
+			return "BOX " + strconv.Itoa(i+1), nil
+		}
+	}
+	return "", errStorageFull
+}
+
+func collectionFull(user map[string]interface{}) bool {
+	return storedCount(decodeListPokemon(user["listPokemon"]), decodeBoxes(user["boxes"])) >= partySize+boxCount*boxCapacity
+}
+
+// SendParty writes the client's active party to conn.
+func (s *Server) SendParty(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		_, _ = conn.Write([]byte("PARTY ERROR " + err.Error() + "\n"))
+		return
+	}
+	data, _ := json.Marshal(decodeListPokemon(user["listPokemon"]))
+	_, _ = conn.Write([]byte("PARTY " + string(data) + "\n"))
+}
+
+// SendBox writes box n (1-based) to conn, or the fill level of every box
+// when n is empty.
+func (s *Server) SendBox(clientID string, conn net.Conn, n string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, err := s.loadUser(clientID)
+	if err != nil {
+		_, _ = conn.Write([]byte("BOX ERROR " + err.Error() + "\n"))
+		return
+	}
+	boxes := decodeBoxes(user["boxes"])
+
+	if n == "" {
+		counts := make([]int, len(boxes))
+		for i, box := range boxes {
+			counts[i] = len(box)
+		}
+		data, _ := json.Marshal(counts)
+		_, _ = conn.Write([]byte(fmt.Sprintf("BOXES %s %d\n", data, boxCapacity)))
+		return
+	}
+
+	index, err := strconv.Atoi(n)
+	if err != nil || index < 1 || index > len(boxes) {
+		_, _ = conn.Write([]byte("BOX ERROR invalid box\n"))
+		return
+	}
+	data, _ := json.Marshal(boxes[index-1])
+	_, _ = conn.Write([]byte("BOX " + n + " " + string(data) + "\n"))
+}
+
+// Deposit moves uid from the party into box n, or the first box with room
+// when n is empty. The last party member cannot be deposited.
+func (s *Server) Deposit(clientID string, conn net.Conn, uid, n string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	box, err := s.deposit(clientID, uid, n)
+	if err != nil {
+		_, _ = conn.Write([]byte("DEPOSIT ERROR " + err.Error() + "\n"))
+		return
+	}
+	_, _ = conn.Write([]byte(fmt.Sprintf("DEPOSITED %s %d\n", uid, box)))
+}
+
+func (s *Server) deposit(clientID, uid, n string) (int, error) {
+	A, err := s.loadClientsData()
+	if err != nil {
+		return 0, err
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return 0, errors.New("unknown player")
+	}
+
+	party := decodeListPokemon(user["listPokemon"])
+	boxes := decodeBoxes(user["boxes"])
+	rest, taken, err := takePokemon(party, []string{uid})
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) == 0 {
+		return 0, errors.New("party cannot be empty")
+	}
+
+	index := -1
+	if n != "" {
+		index, err = strconv.Atoi(n)
+		if err != nil || index < 1 || index > len(boxes) {
+			return 0, errors.New("invalid box")
+		}
+		index--
+		if len(boxes[index]) >= boxCapacity {
+			return 0, errors.New("box full")
+		}
+	} else {
+		for i := range boxes {
+			if len(boxes[i]) < boxCapacity {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return 0, errStorageFull
+		}
+	}
+
+	boxes[index] = append(boxes[index], taken...)
+	setStorage(user, rest, boxes)
+	return index + 1, s.storeClientsData(A)
+}
+
+// Withdraw moves uid from any box into the party if the party has room.
+func (s *Server) Withdraw(clientID string, conn net.Conn, uid string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.withdraw(clientID, uid); err != nil {
+		_, _ = conn.Write([]byte("WITHDRAW ERROR " + err.Error() + "\n"))
+		return
+	}
+	_, _ = conn.Write([]byte("WITHDRAWN " + uid + "\n"))
+}
+
+func (s *Server) withdraw(clientID, uid string) error {
+	A, err := s.loadClientsData()
+	if err != nil {
+		return err
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return errors.New("unknown player")
+	}
+
+	party := decodeListPokemon(user["listPokemon"])
+	if len(party) >= partySize {
+		return errors.New("party full")
+	}
+	boxes := decodeBoxes(user["boxes"])
+	for i := range boxes {
+		rest, taken, err := takePokemon(boxes[i], []string{uid})
+		if err != nil {
+			continue
+		}
+		boxes[i] = rest
+		if boxes[i] == nil {
+			boxes[i] = []Pokemon{}
+		}
+		setStorage(user, append(party, taken...), boxes)
+		return s.storeClientsData(A)
+	}
+	return errors.New("Pokemon not in storage")
+}
+
+// loadUser returns the client's clients.json entry. Caller must hold
+// s.mutex.
+func (s *Server) loadUser(clientID string) (map[string]interface{}, error) {
+	A, err := s.loadClientsData()
+	if err != nil {
+		return nil, err
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return nil, errors.New("unknown player")
+	}
+	return user, nil
+}
@@ -0,0 +1,239 @@
+package PubSub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// TLSOptions configures the listener. Without CertFile the server speaks
+// plain TCP. With ClientCAFile, clients may present a certificate signed
+// by that CA and are logged in as the account named by its Common Name.
+type TLSOptions struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// certReloader serves the certificate and client CA pool from disk and
+// reloads them when the files change, so certificates can be rotated
+// without a restart.
+type certReloader struct {
+	options TLSOptions
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	stamp   string // modification times of the loaded files
+}
+
+func fileStamp(files ...string) string {
+	stamp := ""
+	for _, name := range files {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return ""
+		}
+		stamp += info.ModTime().String() + ";"
+	}
+	return stamp
+}
+
+// reload loads the files again if they changed since the last load. On
+// error the previous certificate stays in use.
+func (r *certReloader) reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stamp := fileStamp(r.options.CertFile, r.options.KeyFile, r.options.ClientCAFile)
+	if stamp != "" && stamp == r.stamp {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.options.CertFile, r.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %v", err)
+	}
+	var pool *x509.CertPool
+	if r.options.ClientCAFile != "" {
+		data, err := os.ReadFile(r.options.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA file: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("error parsing client CA file")
+		}
+	}
+
+	if r.stamp != "" {
+		fmt.Println("TLS certificates reloaded")
+	}
+	r.cert, r.pool, r.stamp = &cert, pool, stamp
+	return nil
+}
+
+// configForClient builds the config for one handshake from the current
+// certificate and CA pool.
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if err := r.reload(); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+	}
+	if r.pool != nil {
+		config.ClientCAs = r.pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Listen opens the server's listener on addr, wrapped in TLS when options
+// name a certificate.
+func Listen(addr string, options TLSOptions) (net.Listener, error) {
+	if options.CertFile == "" {
+		return net.Listen("tcp", addr)
+	}
+	reloader := &certReloader{options: options}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: reloader.configForClient,
+	}
+	return tls.Listen("tcp", addr, config)
+}
+
+// clientCertificateName returns the Common Name of the verified client
+// certificate on conn, if it is a TLS connection that presented one.
+func clientCertificateName(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	_ = tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := tlsConn.Handshake()
+	_ = tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return "", err
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+	return state.PeerCertificates[0].Subject.CommonName, nil
+}
+
+// newCertificate creates a certificate from template, signed by parent
+// and parentKey or self-signed when parent is nil, and writes it and its
+// new key to certFile and keyFile.
+func newCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("error generating serial: %v", err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(365 * 24 * time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return fmt.Errorf("error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("error encoding key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("error writing certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("error writing key: %v", err)
+	}
+	return nil
+}
+
+// GenerateSelfSignedCert writes a self-signed certificate for hosts and
+// its key to certFile and keyFile, for local testing.
+func GenerateSelfSignedCert(certFile, keyFile string, hosts []string) error {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "PubSub test server"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return newCertificate(template, nil, nil, certFile, keyFile)
+}
+
+// GenerateClientCA writes a CA for signing client certificates, to pass
+// as TLSOptions.ClientCAFile, and its key.
+func GenerateClientCA(certFile, keyFile string) error {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "PubSub client CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return newCertificate(template, nil, nil, certFile, keyFile)
+}
+
+// GenerateClientCert writes a client certificate for the account
+// username, signed by the CA in caCertFile and caKeyFile.
+func GenerateClientCert(caCertFile, caKeyFile, username, certFile, keyFile string) error {
+	ca, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading client CA: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing client CA: %v", err)
+	}
+	caKey, ok := ca.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("client CA key is not an ECDSA key")
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: username},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return newCertificate(template, caCert, caKey, certFile, keyFile)
+}
@@ -0,0 +1,200 @@
+package PubSub
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCerts is a server certificate, client CA and client certificate
+// written to a temporary directory.
+type testCerts struct {
+	options    TLSOptions
+	clientCert string
+	clientKey  string
+}
+
+func newTestCerts(t *testing.T, username string) testCerts {
+	t.Helper()
+	dir := t.TempDir()
+	c := testCerts{
+		options: TLSOptions{
+			CertFile:     filepath.Join(dir, "server.pem"),
+			KeyFile:      filepath.Join(dir, "server.key"),
+			ClientCAFile: filepath.Join(dir, "ca.pem"),
+		},
+		clientCert: filepath.Join(dir, username+".pem"),
+		clientKey:  filepath.Join(dir, username+".key"),
+	}
+	caKey := filepath.Join(dir, "ca.key")
+	if err := GenerateSelfSignedCert(c.options.CertFile, c.options.KeyFile, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateClientCA(c.options.ClientCAFile, caKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateClientCert(c.options.ClientCAFile, caKey, username, c.clientCert, c.clientKey); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// dial connects to addr trusting the server certificate currently in
+// c's files, presenting the client certificate when withClientCert is
+// set, and returns the connection after the handshake.
+func (c testCerts) dial(t *testing.T, addr string, withClientCert bool) *tls.Conn {
+	t.Helper()
+	serverPEM, err := os.ReadFile(c.options.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+	config := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+	if withClientCert {
+		cert, err := tls.LoadX509KeyPair(c.clientCert, c.clientKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// acceptNames accepts connections on ln and sends each one's client
+// certificate name, or the handshake error, on the returned channel.
+func acceptNames(ln net.Listener) <-chan string {
+	names := make(chan string)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(names)
+				return
+			}
+			name, err := clientCertificateName(conn)
+			if err != nil {
+				name = "error: " + err.Error()
+			}
+			names <- name
+			conn.Close()
+		}
+	}()
+	return names
+}
+
+func TestClientCertificateName(t *testing.T) {
+	certs := newTestCerts(t, "misty")
+	ln, err := Listen("127.0.0.1:0", certs.options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	names := acceptNames(ln)
+
+	certs.dial(t, ln.Addr().String(), true)
+	if name := <-names; name != "misty" {
+		t.Errorf("name with a client certificate = %q, want misty", name)
+	}
+	certs.dial(t, ln.Addr().String(), false)
+	if name := <-names; name != "" {
+		t.Errorf("name without a client certificate = %q, want none", name)
+	}
+}
+
+func TestListenReloadsCertificate(t *testing.T) {
+	certs := newTestCerts(t, "misty")
+	ln, err := Listen("127.0.0.1:0", certs.options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	names := acceptNames(ln)
+
+	first := certs.dial(t, ln.Addr().String(), true).ConnectionState().PeerCertificates[0]
+	<-names
+
+	if err := GenerateSelfSignedCert(certs.options.CertFile, certs.options.KeyFile, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes even on coarse clocks.
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certs.options.CertFile, certs.options.KeyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	second := certs.dial(t, ln.Addr().String(), true).ConnectionState().PeerCertificates[0]
+	if name := <-names; name != "misty" {
+		t.Errorf("name after the reload = %q, want misty", name)
+	}
+	if bytes.Equal(first.Raw, second.Raw) {
+		t.Error("the server still presents the old certificate after it was replaced")
+	}
+}
+
+func TestCertificateLogin(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	certs := newTestCerts(t, "misty")
+
+	s := newTestServer(t)
+
+	ln, err := Listen("127.0.0.1:0", certs.options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ids := make(chan string)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(ids)
+			return
+		}
+		defer conn.Close()
+		id, _ := s.authenticate(conn, bufio.NewScanner(conn), newTokenBucket(connectionRate, connectionBurst))
+		ids <- id
+	}()
+
+	conn := certs.dial(t, ln.Addr().String(), true)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Achievements for the new party may come before the reply.
+	reader := bufio.NewReader(conn)
+	var line string
+	for !strings.HasPrefix(line, "AUTH ") {
+		if line, err = reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 5 || fields[0] != "AUTH" || fields[1] != "OK" || fields[2] != "misty" {
+		t.Fatalf("reply = %q, want AUTH OK misty <playerID> <token>", line)
+	}
+	if id := <-ids; id != fields[3] {
+		t.Errorf("authenticate returned %q, want %q", id, fields[3])
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list, err := s.loadAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := list.find(func(a *Account) bool { return a.Username == "misty" })
+	if account == nil || account.PlayerID != fields[3] {
+		t.Errorf("no account for misty with player %s", fields[3])
+	}
+}
@@ -0,0 +1,250 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Trade is a negotiation between two players. Offered Pokemon leave the
+// owner's listPokemon for the "escrow" list of their clients.json entry,
+// so every step is a single write and nothing is ever held in memory only.
+type Trade struct {
+	Parties   [2]string           `json:"parties"`
+	Offers    map[string][]string `json:"offers"`
+	Confirmed map[string]bool     `json:"confirmed"`
+}
+
+func (t *Trade) partner(clientID string) string {
+	if t.Parties[0] == clientID {
+		return t.Parties[1]
+	}
+	return t.Parties[0]
+}
+
+// takePokemon splits the Pokemon with the given uids out of list. Every
+// uid must be present.
+func takePokemon(list []Pokemon, uids []string) (rest, taken []Pokemon, err error) {
+	wanted := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		wanted[uid] = true
+	}
+	for _, p := range list {
+		if wanted[p.UID] {
+			taken = append(taken, p)
+			delete(wanted, p.UID)
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	if len(wanted) > 0 {
+		return list, nil, errors.New("Pokemon not owned")
+	}
+	return rest, taken, nil
+}
+
+// releaseEscrow returns everything in user's escrow to their collection.
+// If storage filled up meanwhile the Pokemon go back to the party anyway,
+// since a trade must never lose one.
+func releaseEscrow(user map[string]interface{}) {
+	for _, p := range decodeListPokemon(user["escrow"]) {
+		if _, err := addToCollection(user, p); err != nil {
+			setStorage(user, append(decodeListPokemon(user["listPokemon"]), p), decodeBoxes(user["boxes"]))
+		}
+	}
+	delete(user, "escrow")
+}
+
+// OfferTrade opens a trade with target, or revises the client's side of an
+// existing one as a counter-offer. Any earlier confirmations are reset.
+func (s *Server) OfferTrade(clientID string, conn net.Conn, target string, uids []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.offerTrade(clientID, target, uids); err != nil {
+		_, _ = conn.Write([]byte("TRADE ERROR " + err.Error() + "\n"))
+		return
+	}
+
+	trade := s.trades[clientID]
+	data, _ := json.Marshal(trade)
+	_, _ = conn.Write([]byte("TRADE OFFERED " + string(data) + "\n"))
+	s.writeToClient(target, "TRADE OFFER FROM "+clientID+" "+string(data))
+}
+
+func (s *Server) offerTrade(clientID, target string, uids []string) error {
+	if _, online := s.clients[target]; !online || target == clientID {
+		return errors.New("unknown player")
+	}
+
+	trade, exists := s.trades[clientID]
+	if exists && trade.partner(clientID) != target {
+		return errors.New("already trading with " + trade.partner(clientID))
+	}
+	if other, busy := s.trades[target]; busy && other != trade {
+		return errors.New("player busy")
+	}
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		return err
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return errors.New("unknown player")
+	}
+
+	releaseEscrow(user)
+	rest, taken, err := takePokemon(decodeListPokemon(user["listPokemon"]), uids)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return errors.New("party cannot be empty")
+	}
+	setStorage(user, rest, decodeBoxes(user["boxes"]))
+	if len(taken) > 0 {
+		user["escrow"] = taken
+	}
+	if err := s.storeClientsData(A); err != nil {
+		return err
+	}
+
+	if !exists {
+		trade = &Trade{
+			Parties:   [2]string{clientID, target},
+			Offers:    make(map[string][]string),
+			Confirmed: make(map[string]bool),
+		}
+		s.trades[clientID] = trade
+		s.trades[target] = trade
+	}
+	trade.Offers[clientID] = uids
+	trade.Confirmed = make(map[string]bool)
+	return nil
+}
+
+// ConfirmTrade accepts the current offers. Once both players confirm, the
+// escrowed Pokemon swap owners in one write.
+func (s *Server) ConfirmTrade(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	trade, exists := s.trades[clientID]
+	if !exists {
+		_, _ = conn.Write([]byte("TRADE ERROR no trade\n"))
+		return
+	}
+	partner := trade.partner(clientID)
+	trade.Confirmed[clientID] = true
+	if !trade.Confirmed[partner] {
+		_, _ = conn.Write([]byte("TRADE CONFIRMED waiting for " + partner + "\n"))
+		s.writeToClient(partner, "TRADE CONFIRMED BY "+clientID)
+		return
+	}
+
+	events, err := s.completeTrade(trade)
+	if err != nil {
+		fmt.Printf("Error completing trade: %v\n", err)
+		_, _ = conn.Write([]byte("TRADE ERROR " + err.Error() + "\n"))
+		return
+	}
+	delete(s.trades, clientID)
+	delete(s.trades, partner)
+	for _, party := range trade.Parties {
+		s.writeToClient(party, "TRADE COMPLETE")
+		for _, event := range events[party] {
+			s.writeToClient(party, event)
+		}
+	}
+}
+
+// completeTrade moves each side's escrow into the other's collection,
+// evolving species that evolve by trade, and returns the EVOLVED events per
+// receiving player. Nothing is written if either side lacks room. Caller
+// must hold s.mutex.
+func (s *Server) completeTrade(trade *Trade) (map[string][]string, error) {
+	A, err := s.loadClientsData()
+	if err != nil {
+		return nil, err
+	}
+	first, second := findUser(A, trade.Parties[0]), findUser(A, trade.Parties[1])
+	if first == nil || second == nil {
+		return nil, errors.New("player left")
+	}
+
+	events := make(map[string][]string)
+	toSecond, toFirst := decodeListPokemon(first["escrow"]), decodeListPokemon(second["escrow"])
+	delete(first, "escrow")
+	delete(second, "escrow")
+	for _, move := range []struct {
+		to       string
+		user     map[string]interface{}
+		incoming []Pokemon
+	}{{trade.Parties[0], first, toFirst}, {trade.Parties[1], second, toSecond}} {
+		for _, p := range move.incoming {
+			if event := tradeEvolve(&p); event != "" {
+				events[move.to] = append(events[move.to], event)
+			}
+			if _, err := addToCollection(move.user, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, p := range toFirst {
+		s.registerCaught(first, p.ID)
+	}
+	for _, p := range toSecond {
+		s.registerCaught(second, p.ID)
+	}
+	s.emitGameEvent(first, GameEvent{Type: EventTrade})
+	s.emitGameEvent(second, GameEvent{Type: EventTrade})
+	return events, s.storeClientsData(A)
+}
+
+// tradeEvolve evolves p if its species evolves by trade.
+func tradeEvolve(p *Pokemon) string {
+	sp, ok := lookupSpecies(p.ID)
+	if !ok {
+		return ""
+	}
+	for _, evo := range sp.EvolvesTo {
+		if evo.Trade {
+			return evolve(p, evo.ID)
+		}
+	}
+	return ""
+}
+
+// CancelTrade ends the client's trade and returns both sides' escrow. It
+// is also used when a player disconnects mid-trade.
+func (s *Server) CancelTrade(clientID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	trade, exists := s.trades[clientID]
+	if !exists {
+		return
+	}
+	delete(s.trades, trade.Parties[0])
+	delete(s.trades, trade.Parties[1])
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	for _, party := range trade.Parties {
+		if user := findUser(A, party); user != nil {
+			releaseEscrow(user)
+		}
+	}
+	if err := s.storeClientsData(A); err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	for _, party := range trade.Parties {
+		s.writeToClient(party, "TRADE CANCELLED "+clientID)
+	}
+}
@@ -0,0 +1,243 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const trainersFile = "trainers.json"
+
+type TrainerPokemon struct {
+	ID int `json:"id"`
+	LV int `json:"lv"`
+}
+
+// Trainer is a non-player trainer. It walks Route one tile per tick,
+// looping back to the start, and challenges players who step into the
+// Sight tiles in front of it.
+type Trainer struct {
+	ID       string           `json:"id"`
+	Name     string           `json:"name"`
+	Position Position         `json:"position"`
+	Facing   int              `json:"facing"` // Up, Down, Left, Right (1, 2, 3, 4)
+	Sight    int              `json:"sight"`
+	Route    []Position       `json:"route,omitempty"`
+	Team     []TrainerPokemon `json:"team"`
+	Reward   int              `json:"reward"`
+}
+
+type TrainerList struct {
+	Trainers []Trainer `json:"trainers"`
+}
+
+// trainerPatrol is where a trainer currently stands and looks.
+type trainerPatrol struct {
+	Position Position
+	Facing   int
+	waypoint int
+}
+
+var trainers []Trainer
+
+func LoadTrainers(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening trainers file: %v", err)
+	}
+	defer file.Close()
+
+	var list TrainerList
+	if err := json.NewDecoder(file).Decode(&list); err != nil {
+		return fmt.Errorf("error decoding trainers file: %v", err)
+	}
+	trainers = list.Trainers
+	return nil
+}
+
+func lookupTrainer(id string) (Trainer, bool) {
+	for _, t := range trainers {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return Trainer{}, false
+}
+
+// directionOffset is the tile step for a direction.
+func directionOffset(direction int) (int, int) {
+	switch direction {
+	case 1: // Up
+		return 0, -1
+	case 2: // Down
+		return 0, 1
+	case 3: // Left
+		return -1, 0
+	case 4: // Right
+		return 1, 0
+	}
+	return 0, 0
+}
+
+// inSight reports whether target is on one of the sight tiles in front of
+// a trainer standing at pos.
+func inSight(pos Position, facing, sight int, target Position) bool {
+	dx, dy := directionOffset(facing)
+	if dx == 0 && dy == 0 {
+		return false
+	}
+	for k := 1; k <= sight; k++ {
+		if pos.X+k*dx == target.X && pos.Y+k*dy == target.Y {
+			return true
+		}
+	}
+	return false
+}
+
+// patrolTrainers moves every trainer one tile towards its next waypoint.
+// Caller must hold s.mutex.
+func (s *Server) patrolTrainers() {
+	for _, t := range trainers {
+		patrol, exists := s.trainerPatrols[t.ID]
+		if !exists {
+			patrol = &trainerPatrol{Position: t.Position, Facing: t.Facing}
+			s.trainerPatrols[t.ID] = patrol
+		}
+		if len(t.Route) == 0 {
+			continue
+		}
+
+		target := t.Route[patrol.waypoint]
+		if patrol.Position == target {
+			patrol.waypoint = (patrol.waypoint + 1) % len(t.Route)
+			target = t.Route[patrol.waypoint]
+		}
+		switch {
+		case target.X < patrol.Position.X:
+			patrol.Facing = 3
+		case target.X > patrol.Position.X:
+			patrol.Facing = 4
+		case target.Y < patrol.Position.Y:
+			patrol.Facing = 1
+		case target.Y > patrol.Position.Y:
+			patrol.Facing = 2
+		default:
+			continue
+		}
+		dx, dy := directionOffset(patrol.Facing)
+		patrol.Position.X += dx
+		patrol.Position.Y += dy
+	}
+}
+
+// trainerSightings returns where every trainer stands and looks. Caller
+// must hold s.mutex.
+func (s *Server) trainerSightings() map[string]trainerPatrol {
+	sightings := make(map[string]trainerPatrol, len(s.trainerPatrols))
+	for id, patrol := range s.trainerPatrols {
+		sightings[id] = *patrol
+	}
+	return sightings
+}
+
+// challengeByTrainer starts a battle with the first undefeated trainer
+// that clientID walked into the view of this tick. before holds the
+// trainers' positions from the start of the tick. Caller must hold
+// s.mutex.
+func (s *Server) challengeByTrainer(clientID string, user map[string]interface{}, from Position, before map[string]trainerPatrol) {
+	if s.busy(clientID) {
+		return
+	}
+	to := userPosition(user)
+	defeated := decodeStringSet(user["defeatedTrainers"])
+
+	for _, t := range trainers {
+		patrol, exists := s.trainerPatrols[t.ID]
+		if !exists || defeated[t.ID] || !inSight(patrol.Position, patrol.Facing, t.Sight, to) {
+			continue
+		}
+		if was, ok := before[t.ID]; ok && inSight(was.Position, was.Facing, t.Sight, from) {
+			continue // already in view last tick
+		}
+
+		team := make([]Pokemon, 0, len(t.Team))
+		for _, member := range t.Team {
+			team = append(team, Pokemon{
+				UID: uuid.New().String(),
+				ID:  member.ID,
+				Exp: expForLevel(growthRateOf(member.ID), member.LV),
+				EV:  0.5,
+				LV:  member.LV,
+			})
+		}
+		battle, err := NewTrainerBattle(decodeListPokemon(user["listPokemon"]), team, t.ID, time.Now().UnixNano())
+		if err != nil {
+			fmt.Printf("Error starting trainer battle: %v\n", err)
+			return
+		}
+		s.battles[clientID] = battle
+
+		data, _ := json.Marshal(battle)
+		s.writeToClient(clientID, fmt.Sprintf("TRAINER CHALLENGE %s %s", t.ID, t.Name))
+		s.writeToClient(clientID, "BATTLE STARTED "+string(data))
+		s.publishLocked(worldEventsChannel, fmt.Sprintf("TRAINER BATTLE %s %s", t.ID, clientID))
+		return
+	}
+}
+
+// defeatTrainer pays out a won trainer battle and marks the trainer as
+// beaten so it does not challenge clientID again. Caller must hold
+// s.mutex.
+func (s *Server) defeatTrainer(clientID string, battle *Battle) {
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	user := findUser(A, clientID)
+	if user == nil {
+		return
+	}
+
+	exp := 0
+	for _, opponent := range battle.Team {
+		exp += expYield(opponent.Pokemon)
+	}
+	s.awardExp(user, battle.active().Pokemon.UID, exp)
+	if t, ok := lookupTrainer(battle.Trainer); ok && t.Reward > 0 {
+		s.reward(user, t.Reward, "trainer "+t.ID)
+	}
+	s.emitGameEvent(user, GameEvent{Type: EventBattleWon, SpeciesID: battle.Wild.Pokemon.ID})
+
+	defeated := decodeStringSet(user["defeatedTrainers"])
+	defeated[battle.Trainer] = true
+	list := make([]string, 0, len(defeated))
+	for id := range defeated {
+		list = append(list, id)
+	}
+	user["defeatedTrainers"] = list
+	if err := s.storeClientsData(A); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// decodeStringSet converts a decoded JSON list of strings into a set.
+func decodeStringSet(v interface{}) map[string]bool {
+	set := make(map[string]bool)
+	switch list := v.(type) {
+	case []string:
+		for _, item := range list {
+			set[item] = true
+		}
+	case []interface{}:
+		for _, item := range list {
+			if text, ok := item.(string); ok {
+				set[text] = true
+			}
+		}
+	}
+	return set
+}
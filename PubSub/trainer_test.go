@@ -0,0 +1,105 @@
+package PubSub
+
+import (
+	"testing"
+)
+
+func useTrainers(t *testing.T, list ...Trainer) {
+	t.Helper()
+	saved := trainers
+	trainers = list
+	t.Cleanup(func() { trainers = saved })
+}
+
+func TestInSight(t *testing.T) {
+	pos := Position{X: 10, Y: 10}
+	tests := []struct {
+		name   string
+		facing int
+		sight  int
+		target Position
+		want   bool
+	}{
+		{"right next to it", 4, 3, Position{X: 11, Y: 10}, true},
+		{"at the edge of sight", 4, 3, Position{X: 13, Y: 10}, true},
+		{"beyond sight", 4, 3, Position{X: 14, Y: 10}, false},
+		{"behind", 4, 3, Position{X: 9, Y: 10}, false},
+		{"off the line", 4, 3, Position{X: 11, Y: 11}, false},
+		{"facing up", 1, 2, Position{X: 10, Y: 8}, true},
+		{"facing down", 2, 2, Position{X: 10, Y: 12}, true},
+		{"facing left", 3, 2, Position{X: 9, Y: 10}, true},
+		{"own tile", 4, 3, pos, false},
+		{"no facing", 0, 3, Position{X: 11, Y: 10}, false},
+		{"blind", 4, 0, Position{X: 11, Y: 10}, false},
+	}
+	for _, tt := range tests {
+		if got := inSight(pos, tt.facing, tt.sight, tt.target); got != tt.want {
+			t.Errorf("%s: inSight = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPatrolTrainers(t *testing.T) {
+	useTrainers(t, Trainer{ID: "joey", Position: Position{X: 0, Y: 0}, Facing: 2, Route: []Position{{X: 2, Y: 0}, {X: 0, Y: 0}}})
+	s := newTestServer(t)
+
+	want := []trainerPatrol{
+		{Position: Position{X: 1, Y: 0}, Facing: 4},
+		{Position: Position{X: 2, Y: 0}, Facing: 4},
+		{Position: Position{X: 1, Y: 0}, Facing: 3},
+		{Position: Position{X: 0, Y: 0}, Facing: 3},
+		{Position: Position{X: 1, Y: 0}, Facing: 4},
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for tick, w := range want {
+		s.patrolTrainers()
+		got := s.trainerPatrols["joey"]
+		if got.Position != w.Position || got.Facing != w.Facing {
+			t.Errorf("tick %d: at %v facing %d, want %v facing %d", tick+1, got.Position, got.Facing, w.Position, w.Facing)
+		}
+	}
+}
+
+func TestTrainerRematch(t *testing.T) {
+	useSpecies(t, testBulbasaur, testCharmander, testSquirtle)
+	useTrainers(t, Trainer{ID: "joey", Name: "Joey", Position: Position{X: 10, Y: 10}, Facing: 4, Sight: 3, Team: []TrainerPokemon{{ID: 1, LV: 5}}})
+
+	tests := []struct {
+		name     string
+		from     Position
+		defeated []string
+		busy     bool
+		want     bool
+	}{
+		{"walked into view", Position{X: 12, Y: 11}, nil, false, true},
+		{"already beaten", Position{X: 12, Y: 11}, []string{"joey"}, false, false},
+		{"another trainer beaten", Position{X: 12, Y: 11}, []string{"brock"}, false, true},
+		{"was in view last tick", Position{X: 13, Y: 10}, nil, false, false},
+		{"already battling", Position{X: 12, Y: 11}, nil, true, false},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t)
+		s.mutex.Lock()
+		s.patrolTrainers()
+		user := map[string]interface{}{"uID": "ash", "positionX": 12, "positionY": 10}
+		newUserStorage(user, testParty())
+		if tt.defeated != nil {
+			user["defeatedTrainers"] = tt.defeated
+		}
+		if tt.busy {
+			s.encounters["ash"] = &Encounter{}
+		}
+		before := s.trainerSightings()
+		s.challengeByTrainer("ash", user, tt.from, before)
+		battle := s.battles["ash"]
+		s.mutex.Unlock()
+
+		if got := battle != nil; got != tt.want {
+			t.Errorf("%s: challenged = %v, want %v", tt.name, got, tt.want)
+		}
+		if battle != nil && battle.Trainer != "joey" {
+			t.Errorf("%s: battle against %q, want joey", tt.name, battle.Trainer)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	mailboxFile       = "mailbox.json"
+	maxStoredWhispers = 100
+	whisperChannel    = "whisper" // for MUTE <player> whisper
+)
+
+// Kinds of stored mail.
+const (
+	mailWhisper = "whisper"
+	mailReceipt = "receipt"
+)
+
+var (
+	errBlocked     = errors.New("not accepting messages from you")
+	errMailboxFull = errors.New("mailbox full")
+)
+
+// Mail is a whisper, or a delivery receipt for one, waiting for its
+// recipient to log in.
+type Mail struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	From    string    `json:"from"`
+	Name    string    `json:"name"` // sender's username, or recipient's for a receipt
+	Message string    `json:"message,omitempty"`
+	Sent    time.Time `json:"sent"`
+}
+
+// Mailbox holds every player's undelivered mail and block list.
+type Mailbox struct {
+	Mail   map[string][]Mail   `json:"mail"`
+	Blocks map[string][]string `json:"blocks"`
+}
+
+// loadMailbox decodes mailboxFile. Caller must hold s.mutex.
+func (s *Server) loadMailbox() (*Mailbox, error) {
+	mailbox := &Mailbox{}
+	file, err := os.Open(mailboxFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error opening mailbox file: %v", err)
+	}
+	if err == nil {
+		defer file.Close()
+		if err := json.NewDecoder(file).Decode(mailbox); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error decoding mailbox file: %v", err)
+		}
+	}
+	if mailbox.Mail == nil {
+		mailbox.Mail = make(map[string][]Mail)
+	}
+	if mailbox.Blocks == nil {
+		mailbox.Blocks = make(map[string][]string)
+	}
+	return mailbox, nil
+}
+
+// storeMailbox writes mailbox to mailboxFile. Caller must hold s.mutex.
+func (s *Server) storeMailbox(mailbox *Mailbox) error {
+	file, err := os.Create(mailboxFile)
+	if err != nil {
+		return fmt.Errorf("error creating mailbox file: %v", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(mailbox); err != nil {
+		return fmt.Errorf("error encoding mailbox file: %v", err)
+	}
+	return nil
+}
+
+func (m *Mailbox) blocks(playerID, other string) bool {
+	for _, id := range m.Blocks[playerID] {
+		if id == other {
+			return true
+		}
+	}
+	return false
+}
+
+// post queues mail for playerID unless their mailbox is full.
+func (m *Mailbox) post(playerID string, mail Mail) error {
+	if len(m.Mail[playerID]) >= maxStoredWhispers {
+		return errMailboxFull
+	}
+	m.Mail[playerID] = append(m.Mail[playerID], mail)
+	return nil
+}
+
+// Whisper sends message from clientID to target, a username or playerID,
+// only. An offline target gets it at their next login. The sender is
+// told WHISPER DELIVERED or WHISPER STORED with the message ID, and a
+// stored whisper's receipt follows once it is delivered.
+func (s *Server) Whisper(clientID string, conn net.Conn, target, message string) {
+	targetID, targetName, err := s.resolvePlayer(target)
+	if err == nil && targetID == clientID {
+		err = errors.New("cannot whisper to yourself")
+	}
+	if err == nil && s.moderation.Muted(clientID, whisperChannel) {
+		err = errMuted
+	}
+	if err != nil {
+		_, _ = conn.Write([]byte("WHISPER ERROR " + target + " " + err.Error() + "\n"))
+		return
+	}
+	_, senderName, err := s.resolvePlayer(clientID)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	mail := Mail{
+		ID:      uuid.New().String(),
+		Kind:    mailWhisper,
+		From:    clientID,
+		Name:    senderName,
+		Message: s.moderation.Filter(message),
+		Sent:    time.Now(),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mailbox, err := s.loadMailbox()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	if mailbox.blocks(targetID, clientID) {
+		s.writeToClient(clientID, "WHISPER ERROR "+target+" "+errBlocked.Error())
+		return
+	}
+
+	if _, online := s.clients[targetID]; online {
+		s.writeToClient(targetID, whisperLine(mail))
+		s.writeToClient(clientID, "WHISPER DELIVERED "+mail.ID+" "+targetName)
+		return
+	}
+	if err := mailbox.post(targetID, mail); err != nil {
+		s.writeToClient(clientID, "WHISPER ERROR "+target+" "+err.Error())
+		return
+	}
+	if err := s.storeMailbox(mailbox); err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	s.writeToClient(clientID, "WHISPER STORED "+mail.ID+" "+targetName)
+}
+
+func whisperLine(mail Mail) string {
+	if mail.Kind == mailReceipt {
+		return "WHISPER DELIVERED " + mail.ID + " " + mail.Name
+	}
+	return "WHISPER FROM " + mail.Name + " " + mail.ID + " " + mail.Message
+}
+
+// deliverMail sends clientID the mail stored while they were offline and
+// a receipt to the sender of every whisper among it. Caller must hold
+// s.mutex.
+func (s *Server) deliverMail(clientID string) {
+	mailbox, err := s.loadMailbox()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	pending := mailbox.Mail[clientID]
+	if len(pending) == 0 {
+		return
+	}
+	delete(mailbox.Mail, clientID)
+
+	var name string
+	for _, mail := range pending {
+		s.writeToClient(clientID, whisperLine(mail))
+		if mail.Kind != mailWhisper {
+			continue
+		}
+		if name == "" {
+			if list, err := s.loadAccounts(); err == nil {
+				if account := list.find(func(a *Account) bool { return a.PlayerID == clientID }); account != nil {
+					name = account.Username
+				}
+			}
+		}
+		receipt := Mail{ID: mail.ID, Kind: mailReceipt, From: clientID, Name: name, Sent: time.Now()}
+		if _, online := s.clients[mail.From]; online {
+			s.writeToClient(mail.From, whisperLine(receipt))
+		} else if err := mailbox.post(mail.From, receipt); err != nil {
+			fmt.Printf("Dropped receipt for %s: %v\n", mail.From, err)
+		}
+	}
+	if err := s.storeMailbox(mailbox); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// Block adds target to clientID's block list, or removes them when
+// unblock is set. Blocked players' whispers are refused.
+func (s *Server) Block(clientID string, conn net.Conn, target string, unblock bool) {
+	targetID, targetName, err := s.resolvePlayer(target)
+	if err != nil {
+		_, _ = conn.Write([]byte("BLOCK ERROR " + err.Error() + "\n"))
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mailbox, err := s.loadMailbox()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	blocked := make([]string, 0, len(mailbox.Blocks[clientID])+1)
+	for _, id := range mailbox.Blocks[clientID] {
+		if id != targetID {
+			blocked = append(blocked, id)
+		}
+	}
+	action := "UNBLOCKED"
+	if !unblock {
+		blocked = append(blocked, targetID)
+		action = "BLOCKED"
+	}
+	mailbox.Blocks[clientID] = blocked
+	if err := s.storeMailbox(mailbox); err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	s.writeToClient(clientID, action+" "+targetName)
+}
+
+// SendBlocks writes clientID's block list to conn by username.
+func (s *Server) SendBlocks(clientID string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mailbox, err := s.loadMailbox()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	list, err := s.loadAccounts()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	names := make([]string, 0, len(mailbox.Blocks[clientID]))
+	for _, id := range mailbox.Blocks[clientID] {
+		if account := list.find(func(a *Account) bool { return a.PlayerID == id }); account != nil {
+			names = append(names, account.Username)
+		}
+	}
+	sort.Strings(names)
+	data, _ := json.Marshal(names)
+	_, _ = conn.Write([]byte("BLOCKS " + string(data) + "\n"))
+}
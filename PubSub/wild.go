@@ -0,0 +1,195 @@
+package PubSub
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	habitatRadius = 6   // tiles a wild Pokemon wanders from its spawn point
+	fleeRadius    = 3   // tiles at which a wild Pokemon notices a player
+	wanderChance  = 0.5 // per tick, for a wild Pokemon nobody is near
+	fastSpeed     = 100 // base Speed from which a fleeing Pokemon runs two tiles
+	mapSize       = 100 // the map's tiles run from 0 to mapSize-1 on both axes
+)
+
+// fleeChance is how likely species id is to run from a nearby player each
+// tick. Fast species are skittish and rare ones, with a low catch rate,
+// more so.
+func fleeChance(id int) float64 {
+	sp, ok := lookupSpecies(id)
+	if !ok {
+		return 0.3
+	}
+	chance := float64(sp.BaseStats.Speed) / 150
+	if sp.CatchRate <= 45 {
+		chance += 0.2
+	}
+	switch {
+	case chance < 0.1:
+		return 0.1
+	case chance > 0.9:
+		return 0.9
+	}
+	return chance
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func onMap(pos Position) bool {
+	return pos.X >= 0 && pos.X < mapSize && pos.Y >= 0 && pos.Y < mapSize
+}
+
+// clampToMap returns the tile of the map nearest to pos.
+func clampToMap(pos Position) Position {
+	clamp := func(v int) int {
+		if v < 0 {
+			return 0
+		}
+		if v >= mapSize {
+			return mapSize - 1
+		}
+		return v
+	}
+	return Position{X: clamp(pos.X), Y: clamp(pos.Y)}
+}
+
+// canStep reports whether a wild Pokemon living at home may move from
+// pos to next: it must stay on the map and within habitatRadius of home,
+// unless the step brings it back closer to home.
+func canStep(pos, next, home Position) bool {
+	if !onMap(next) {
+		return false
+	}
+	return distance(next, home) <= habitatRadius || homeward(pos, next, home)
+}
+
+// homeward reports whether next is nearer home than pos along either axis
+// without moving away on the other.
+func homeward(pos, next, home Position) bool {
+	return abs(next.X-home.X)+abs(next.Y-home.Y) < abs(pos.X-home.X)+abs(pos.Y-home.Y)
+}
+
+// fleeStep moves pos one tile away from threat, straight or along one
+// axis, and stays put when cornered.
+func fleeStep(pos, threat, home Position) Position {
+	dx, dy := sign(pos.X-threat.X), sign(pos.Y-threat.Y)
+	if dx == 0 && dy == 0 {
+		dx, dy = directionOffset(rand.Intn(4) + 1)
+	}
+	for _, next := range []Position{
+		{X: pos.X + dx, Y: pos.Y + dy},
+		{X: pos.X + dx, Y: pos.Y},
+		{X: pos.X, Y: pos.Y + dy},
+	} {
+		if next != pos && canStep(pos, next, home) {
+			return next
+		}
+	}
+	return pos
+}
+
+// wanderStep moves pos one tile in a random direction without leaving
+// the map or habitatRadius of home.
+func wanderStep(pos, home Position) Position {
+	dx, dy := directionOffset(rand.Intn(4) + 1)
+	next := Position{X: pos.X + dx, Y: pos.Y + dy}
+	if !canStep(pos, next, home) {
+		return pos
+	}
+	return next
+}
+
+// MoveWildPokemon lets every wild Pokemon not in an encounter wander or
+// flee from the nearest player, and tells players within viewRadius.
+func (s *Server) MoveWildPokemon() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	A, err := s.loadClientsData()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	pokemonWorldList, err := loadPokemonWorld()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	engaged := make(map[string]bool)
+	for _, enc := range s.encounters {
+		engaged[enc.Pokemon.UID] = true
+	}
+	players := make(map[string]Position)
+	for clientID := range s.clients {
+		if user := findUser(A, clientID); user != nil {
+			players[clientID] = userPosition(user)
+		}
+	}
+
+	moved := false
+	for i := range pokemonWorldList.PokemonWorlds {
+		pokemonWorld := &pokemonWorldList.PokemonWorlds[i]
+		if engaged[pokemonWorld.Pokemon.UID] {
+			continue
+		}
+		if pokemonWorld.Home == nil {
+			home := pokemonWorld.Position
+			pokemonWorld.Home = &home
+		}
+
+		from := pokemonWorld.Position
+		action := "MOVED"
+		if threat, near := nearestPlayer(players, from); near && rand.Float64() < fleeChance(pokemonWorld.Pokemon.ID) {
+			action = "FLED"
+			pokemonWorld.Position = fleeStep(from, threat, *pokemonWorld.Home)
+			if sp, ok := lookupSpecies(pokemonWorld.Pokemon.ID); ok && sp.BaseStats.Speed >= fastSpeed {
+				pokemonWorld.Position = fleeStep(pokemonWorld.Position, threat, *pokemonWorld.Home)
+			}
+		} else if !near && rand.Float64() < wanderChance {
+			pokemonWorld.Position = wanderStep(from, *pokemonWorld.Home)
+		}
+		if pokemonWorld.Position == from {
+			continue
+		}
+		moved = true
+
+		message := fmt.Sprintf("WILD %s %s %d %d %d", action, pokemonWorld.Pokemon.UID, pokemonWorld.Pokemon.ID,
+			pokemonWorld.Position.X, pokemonWorld.Position.Y)
+		for clientID, pos := range players {
+			if distance(pos, from) <= viewRadius || distance(pos, pokemonWorld.Position) <= viewRadius {
+				s.writeToClient(clientID, message)
+			}
+		}
+	}
+	if !moved {
+		return
+	}
+	if err := storePokemonWorld(pokemonWorldList); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// nearestPlayer returns the position of the closest player within
+// fleeRadius of pos.
+func nearestPlayer(players map[string]Position, pos Position) (Position, bool) {
+	var nearest Position
+	found := false
+	for _, player := range players {
+		d := distance(player, pos)
+		if d > fleeRadius || (found && d >= distance(nearest, pos)) {
+			continue
+		}
+		nearest, found = player, true
+	}
+	return nearest, found
+}
@@ -0,0 +1,80 @@
+package PubSub
+
+import (
+	"testing"
+)
+
+func TestCanStep(t *testing.T) {
+	home := Position{X: 50, Y: 50}
+	tests := []struct {
+		name      string
+		pos, next Position
+		home      Position
+		want      bool
+	}{
+		{"inside the habitat", home, Position{X: 51, Y: 50}, home, true},
+		{"onto the habitat edge", Position{X: 55, Y: 50}, Position{X: 56, Y: 56}, home, true},
+		{"out of the habitat", Position{X: 56, Y: 50}, Position{X: 57, Y: 50}, home, false},
+		{"back towards home from outside", Position{X: 60, Y: 50}, Position{X: 59, Y: 50}, home, true},
+		{"sideways outside the habitat", Position{X: 60, Y: 50}, Position{X: 60, Y: 51}, home, false},
+		{"off the left edge", Position{X: 0, Y: 0}, Position{X: -1, Y: 0}, Position{X: 0, Y: 0}, false},
+		{"off the bottom edge", Position{X: 5, Y: mapSize - 1}, Position{X: 5, Y: mapSize}, Position{X: 5, Y: mapSize - 1}, false},
+		{"along the edge", Position{X: 0, Y: 0}, Position{X: 0, Y: 1}, Position{X: 0, Y: 0}, true},
+	}
+	for _, tt := range tests {
+		if got := canStep(tt.pos, tt.next, tt.home); got != tt.want {
+			t.Errorf("%s: canStep(%v, %v, %v) = %v, want %v", tt.name, tt.pos, tt.next, tt.home, got, tt.want)
+		}
+	}
+}
+
+func TestFleeStep(t *testing.T) {
+	home := Position{X: 50, Y: 50}
+	corner := Position{X: mapSize - 1, Y: mapSize - 1}
+	tests := []struct {
+		name              string
+		pos, threat, home Position
+		want              Position
+	}{
+		{"straight away", home, Position{X: 48, Y: 50}, home, Position{X: 51, Y: 50}},
+		{"diagonally away", home, Position{X: 49, Y: 49}, home, Position{X: 51, Y: 51}},
+		{"along the wall", Position{X: mapSize - 1, Y: 50}, Position{X: mapSize - 2, Y: 49}, Position{X: mapSize - 1, Y: 50}, Position{X: mapSize - 1, Y: 51}},
+		{"cornered by the map", corner, Position{X: mapSize - 2, Y: mapSize - 2}, corner, corner},
+		{"cornered by the habitat", Position{X: 56, Y: 50}, Position{X: 55, Y: 50}, home, Position{X: 56, Y: 50}},
+		{"around the habitat edge", Position{X: 56, Y: 50}, Position{X: 55, Y: 49}, home, Position{X: 56, Y: 51}},
+	}
+	for _, tt := range tests {
+		if got := fleeStep(tt.pos, tt.threat, tt.home); got != tt.want {
+			t.Errorf("%s: fleeStep(%v, %v, %v) = %v, want %v", tt.name, tt.pos, tt.threat, tt.home, got, tt.want)
+		}
+	}
+
+	// A player on the same tile sends it off in a random direction.
+	for i := 0; i < 100; i++ {
+		if got := fleeStep(home, home, home); distance(got, home) != 1 {
+			t.Fatalf("fleeing from its own tile moved to %v", got)
+		}
+	}
+}
+
+func TestWanderStep(t *testing.T) {
+	tests := []struct {
+		name string
+		home Position
+	}{
+		{"open ground", Position{X: 50, Y: 50}},
+		{"corner", Position{X: 0, Y: 0}},
+		{"far corner", Position{X: mapSize - 1, Y: mapSize - 1}},
+		{"edge", Position{X: 50, Y: 0}},
+	}
+	for _, tt := range tests {
+		pos := tt.home
+		for i := 0; i < 1000; i++ {
+			next := wanderStep(pos, tt.home)
+			if !onMap(next) || distance(next, tt.home) > habitatRadius || distance(next, pos) > 1 || (next.X != pos.X && next.Y != pos.Y) {
+				t.Fatalf("%s: wandered from %v to %v", tt.name, pos, next)
+			}
+			pos = next
+		}
+	}
+}
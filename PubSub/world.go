@@ -0,0 +1,271 @@
+package PubSub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	regionsFile         = "regions.json"
+	worldChannel        = "world"
+	wildPopulation      = 50   // wild Pokemon the spawner keeps on the map
+	weatherChangeChance = 0.25 // per region, per game hour
+	hoursPerDay         = 24
+	startHour           = 8
+	boostWeight         = 4 // spawn weight of a species favoured by conditions
+)
+
+// Day phases.
+const (
+	PhaseDay   = "day"
+	PhaseNight = "night"
+)
+
+// Weather kinds.
+const (
+	WeatherClear = "clear"
+	WeatherRain  = "rain"
+	WeatherSun   = "sun"
+	WeatherFog   = "fog"
+)
+
+// phaseBoosts and weatherBoosts list the types that spawn more often under
+// each condition.
+var phaseBoosts = map[string][]string{
+	PhaseDay:   {"normal", "grass", "bug", "flying"},
+	PhaseNight: {"ghost", "poison", "psychic"},
+}
+
+var weatherBoosts = map[string][]string{
+	WeatherRain: {"water", "electric"},
+	WeatherSun:  {"fire", "grass", "ground"},
+	WeatherFog:  {"ghost", "psychic", "ice"},
+}
+
+// levelBonus raises wild levels at night and in rough weather.
+var levelBonus = map[string]int{
+	PhaseNight:  2,
+	WeatherRain: 1,
+	WeatherFog:  2,
+}
+
+// Region is a rectangle of the map with its own weather, drawn from
+// Weathers.
+type Region struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Min      Position `json:"min"`
+	Max      Position `json:"max"`
+	Weathers []string `json:"weathers"`
+}
+
+type RegionList struct {
+	Regions []Region `json:"regions"`
+}
+
+// WorldConditions is the state published on the world channel.
+type WorldConditions struct {
+	Hour    int               `json:"hour"`
+	Phase   string            `json:"phase"`
+	Weather map[string]string `json:"weather"`
+}
+
+var regions []Region
+
+// World is the game clock and the current weather of every region. It has
+// its own lock and may be used with or without s.mutex held.
+type World struct {
+	mutex   sync.Mutex
+	hour    int
+	weather map[string]string
+}
+
+// worldState is shared by the server and the spawner.
+var worldState = &World{hour: startHour, weather: map[string]string{}}
+
+func LoadRegions(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening regions file: %v", err)
+	}
+	defer file.Close()
+
+	var list RegionList
+	if err := json.NewDecoder(file).Decode(&list); err != nil {
+		return fmt.Errorf("error decoding regions file: %v", err)
+	}
+	regions = list.Regions
+
+	worldState.mutex.Lock()
+	defer worldState.mutex.Unlock()
+	worldState.weather = make(map[string]string, len(regions))
+	for _, region := range regions {
+		worldState.weather[region.ID] = WeatherClear
+	}
+	return nil
+}
+
+func regionAt(pos Position) (Region, bool) {
+	for _, region := range regions {
+		if pos.X >= region.Min.X && pos.X <= region.Max.X && pos.Y >= region.Min.Y && pos.Y <= region.Max.Y {
+			return region, true
+		}
+	}
+	return Region{}, false
+}
+
+func phaseOf(hour int) string {
+	if hour >= 6 && hour < 18 {
+		return PhaseDay
+	}
+	return PhaseNight
+}
+
+// Advance moves the clock on one hour and rerolls the weather of some
+// regions. It returns the new conditions.
+func (w *World) Advance() WorldConditions {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.hour = (w.hour + 1) % hoursPerDay
+	for _, region := range regions {
+		if len(region.Weathers) > 0 && rand.Float64() < weatherChangeChance {
+			w.weather[region.ID] = region.Weathers[rand.Intn(len(region.Weathers))]
+		}
+	}
+	return w.conditionsLocked()
+}
+
+func (w *World) Conditions() WorldConditions {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.conditionsLocked()
+}
+
+func (w *World) conditionsLocked() WorldConditions {
+	weather := make(map[string]string, len(w.weather))
+	for id, kind := range w.weather {
+		weather[id] = kind
+	}
+	return WorldConditions{Hour: w.hour, Phase: phaseOf(w.hour), Weather: weather}
+}
+
+// conditionsAt returns the day phase and the weather at pos. Tiles outside
+// every region are always clear.
+func (w *World) conditionsAt(pos Position) (phase, weather string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	weather = WeatherClear
+	if region, ok := regionAt(pos); ok {
+		weather = w.weather[region.ID]
+	}
+	return phaseOf(w.hour), weather
+}
+
+func hasAnyType(sp Species, types []string) bool {
+	for _, t := range sp.Types {
+		for _, boosted := range types {
+			if t == boosted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spawnSpeciesID picks a species, favouring the types boosted by phase and
+// weather.
+func spawnSpeciesID(phase, weather string) int {
+	if len(speciesIDs) == 0 {
+		return randomSpeciesID()
+	}
+	weights := make([]int, len(speciesIDs))
+	total := 0
+	for i, id := range speciesIDs {
+		sp := speciesCatalog[id]
+		weights[i] = 1
+		if hasAnyType(sp, phaseBoosts[phase]) || hasAnyType(sp, weatherBoosts[weather]) {
+			weights[i] = boostWeight
+		}
+		total += weights[i]
+	}
+	r := rand.Intn(total)
+	for i, weight := range weights {
+		if r < weight {
+			return speciesIDs[i]
+		}
+		r -= weight
+	}
+	return speciesIDs[len(speciesIDs)-1]
+}
+
+// createWildPokemon spawns a Pokemon suited to the conditions at pos.
+func createWildPokemon(pos Position) Pokemon {
+	phase, weather := worldState.conditionsAt(pos)
+	p := createRandomPokemon()
+	p.ID = spawnSpeciesID(phase, weather)
+	p.LV += levelBonus[phase] + levelBonus[weather]
+	return p
+}
+
+func worldMessage(conditions WorldConditions) string {
+	data, _ := json.Marshal(conditions)
+	return "WORLD " + string(data)
+}
+
+// startWorldClock advances the world by one game hour per tick, publishes
+// the new conditions and tops up the wild population.
+func (s *Server) startWorldClock() {
+	for s.tick(s.worldTicker) {
+		s.PublishRetained(worldChannel, worldMessage(worldState.Advance()))
+		s.replenishWildPokemon()
+	}
+}
+
+// replenishWildPokemon spawns wild Pokemon until wildPopulation is reached.
+func (s *Server) replenishWildPokemon() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pokemonWorldList, err := loadPokemonWorld()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	missing := wildPopulation - len(pokemonWorldList.PokemonWorlds)
+	if missing <= 0 {
+		return
+	}
+	for i := 0; i < missing; i++ {
+		pokemonWorldList.PokemonWorlds = append(pokemonWorldList.PokemonWorlds, createRandomPokemonWorld())
+	}
+	if err := storePokemonWorld(pokemonWorldList); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// PublishRetained publishes message on channel and keeps it as the
+// channel's current state for later subscribers.
+func (s *Server) PublishRetained(channel, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.retained[channel] = message
+	s.publishLocked(channel, message)
+}
+
+// sendRetained writes the retained state of channel, if any, to conn.
+// Caller must hold s.mutex.
+func (s *Server) sendRetained(channel string, conn net.Conn) {
+	message, exists := s.retained[channel]
+	if !exists {
+		return
+	}
+	if _, err := conn.Write([]byte(message + "\n")); err != nil {
+		fmt.Printf("Error sending retained message: %v\n", err)
+	}
+}
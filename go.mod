@@ -8,4 +8,5 @@ require (
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/googollee/go-socket.io v1.7.0 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
+	golang.org/x/crypto v0.32.0 // indirect
 )
@@ -1,14 +1,54 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"net"
+	"os"
 	"server/PubSub"
+	"strings"
 )
 
 func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	certFile := flag.String("tls-cert", "", "TLS certificate file; plain TCP when empty")
+	keyFile := flag.String("tls-key", "", "TLS private key file")
+	clientCAFile := flag.String("tls-client-ca", "", "CA file for optional client certificates")
+	sayRadius := flag.Int("say-radius", PubSub.DefaultSayRadius, "tiles around a player that SAY reaches")
+	selfSigned := flag.String("tls-self-signed", "", "write a self-signed certificate for these comma-separated hosts to -tls-cert and -tls-key first")
+	clientCAKey := flag.String("tls-client-ca-key", "", "key of -tls-client-ca, for -tls-issue-client")
+	issueClient := flag.String("tls-issue-client", "", "write a client certificate for this username to <username>.pem and <username>.key, creating -tls-client-ca first if missing, and exit")
+	flag.Parse()
+
+	if *issueClient != "" {
+		if _, err := os.Stat(*clientCAFile); os.IsNotExist(err) {
+			if err := PubSub.GenerateClientCA(*clientCAFile, *clientCAKey); err != nil {
+				fmt.Printf("Error generating client CA: %v\n", err)
+				return
+			}
+		}
+		if err := PubSub.GenerateClientCert(*clientCAFile, *clientCAKey, *issueClient, *issueClient+".pem", *issueClient+".key"); err != nil {
+			fmt.Printf("Error generating client certificate: %v\n", err)
+			return
+		}
+		fmt.Printf("Wrote %s.pem and %s.key\n", *issueClient, *issueClient)
+		return
+	}
+
+	if *selfSigned != "" {
+		if err := PubSub.GenerateSelfSignedCert(*certFile, *keyFile, strings.Split(*selfSigned, ",")); err != nil {
+			fmt.Printf("Error generating certificate: %v\n", err)
+			return
+		}
+	}
+
+	PubSub.LoadCatalogs()
 	server := PubSub.NewServer("clients.json")
-	ln, err := net.Listen("tcp", ":8080")
+	server.SetSayRadius(*sayRadius)
+	ln, err := PubSub.Listen(*addr, PubSub.TLSOptions{
+		CertFile:     *certFile,
+		KeyFile:      *keyFile,
+		ClientCAFile: *clientCAFile,
+	})
 	if err != nil {
 		fmt.Printf("Error starting server: %v\n", err)
 		return
@@ -17,7 +57,7 @@ func main() {
 
 	PubSub.InitiatePoke()
 
-	fmt.Println("Server started on :8080")
+	fmt.Println("Server started on " + *addr)
 
 	// Start the console command handler
 	go PubSub.HandleServerCommands(server)
@@ -28,6 +68,9 @@ func main() {
 			fmt.Printf("Error accepting connection: %v\n", err)
 			continue
 		}
+		if server.RefuseBanned(conn) {
+			continue
+		}
 		fmt.Println("New client connected")
 		go server.HandleConnection(conn)
 	}